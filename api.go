@@ -1,33 +1,61 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 type api struct {
-	pre  preprocessor
-	repo repository
-	post postprocessor
+	pre      preprocessor
+	repo     repository
+	search   searcher
+	images   imageStore
+	resizer  resizer
+	post     postprocessor
+	stats    *popularity
+	maxImage int64 // bytes
+	proxies  trustedProxies
 	*mux.Router
 }
 
-func newAPI(pre preprocessor, repo repository, post postprocessor, imagedir string) *api {
+func newAPI(pre preprocessor, repo repository, search searcher, images imageStore, resizer resizer, post postprocessor, stats *popularity, maxImage int64, proxies trustedProxies) *api {
 	a := &api{
-		pre:  pre,
-		repo: repo,
-		post: post,
+		pre:      pre,
+		repo:     repo,
+		search:   search,
+		images:   images,
+		resizer:  resizer,
+		post:     post,
+		stats:    stats,
+		maxImage: maxImage,
+		proxies:  proxies,
 	}
 	r := mux.NewRouter()
 	{
 		r.StrictSlash(true)
 		r.Methods("GET").Path("/").HandlerFunc(a.handleRoot)
+		r.Methods("GET").Path("/breakfasts").HandlerFunc(a.handleListBreakfasts)
 		r.Methods("GET").Path("/breakfasts/{id:[0-9]+}").HandlerFunc(a.handleGetBreakfast)
-		r.Methods("GET").PathPrefix("/images").Handler(http.StripPrefix("/images", http.FileServer(http.Dir(imagedir))))
+		r.Methods("POST").Path("/breakfasts/{id:[0-9]+}/rating").HandlerFunc(a.handleRateBreakfast)
+		r.Methods("GET").Path("/favorites").HandlerFunc(a.handleGetFavorites)
+		r.Methods("POST").Path("/favorites").HandlerFunc(a.handleSetFavorite)
+		r.Methods("DELETE").Path("/favorites/{id:[0-9]+}").HandlerFunc(a.handleSetFavorite)
+		r.Methods("GET").Path("/today").HandlerFunc(a.handleToday)
+		r.Methods("GET").Path("/search").HandlerFunc(a.handleSearch)
+		r.Methods("POST").Path("/breakfasts/{id:[0-9]+}/image").HandlerFunc(a.handleUploadImage)
+		r.Methods("GET").Path("/images/{key}").HandlerFunc(a.handleGetImage)
+		r.Methods("GET").Path("/stats").HandlerFunc(a.handleStats)
 		r.Methods("GET").Path("/admin").HandlerFunc(a.handleAdmin)
 	}
 	a.Router = r
@@ -37,45 +65,496 @@ func newAPI(pre preprocessor, repo repository, post postprocessor, imagedir stri
 func (a *api) handleRoot(w http.ResponseWriter, r *http.Request) {
 	var (
 		username = getUsername(r)
-		region   = getRegion(r)
+		seed, _  = strconv.ParseInt(r.URL.Query().Get("seed"), 10, 64)
+		filter   = getFilter(r)
+		mode     = selectionMode(r.URL.Query().Get("mode"))
 	)
 
-	a.pre(r.Context(), region)
+	switch mode {
+	case "":
+		mode = modeCycle
+	case modeCycle, modePopular:
+	default:
+		http.Error(w, fmt.Sprintf("unknown mode %q", mode), http.StatusBadRequest)
+		return
+	}
 
-	b, err := a.repo.getRandomBreakfast(r.Context(), username)
+	ctx := a.pre(r.Context(), a.proxies.originIP(r))
 
-	a.post(r.Context(), username, err == nil)
+	b, _, err := a.repo.getRandomBreakfast(ctx, username, randomQuery{seed, filter, mode})
+	if err == errBreakerOpen {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable) // fail fast, skip postprocessing
+		return
+	}
+
+	if err == nil {
+		ctx = withBreakfastID(ctx, b.ID)
+	}
+	ctx = a.post(ctx, username, err == nil)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		http.Error(w, err.Error(), errorCode(err))
 		return
 	}
 
+	a.stats.served(b, getContextRegion(ctx), servedRandom)
+
 	w.Header().Set("Cache-Control", "private") // don't cache, it's random!
+	if wantsJSON(r) {
+		writeJSON(w, b)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	writeHTML(w, b)
+	writeHTML(w, b, nil)
+}
+
+func (a *api) handleListBreakfasts(w http.ResponseWriter, r *http.Request) {
+	var (
+		username = getUsername(r)
+		filter   = getFilter(r)
+	)
+
+	ctx := a.pre(r.Context(), a.proxies.originIP(r))
+
+	list, err := a.repo.listBreakfasts(ctx, username, filter)
+	if err == errBreakerOpen {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable) // fail fast, skip postprocessing
+		return
+	}
+
+	a.post(ctx, username, err == nil)
+
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, list)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writeListHTML(w, "All breakfasts", list)
 }
 
 func (a *api) handleGetBreakfast(w http.ResponseWriter, r *http.Request) {
 	var (
 		username = getUsername(r)
-		region   = getRegion(r)
 		id, _    = strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
 	)
 
-	a.pre(r.Context(), region)
+	ctx := a.pre(r.Context(), a.proxies.originIP(r))
+
+	b, err := a.repo.getBreakfast(ctx, username, id)
+	if err == errBreakerOpen {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable) // fail fast, skip postprocessing
+		return
+	}
+
+	var related []breakfast
+	if err == nil {
+		var relatedErr error
+		related, relatedErr = a.repo.getRelatedBreakfasts(ctx, username, id)
+		if relatedErr != nil {
+			getContextLogger(ctx).add("related_err", relatedErr) // nice to have, so serve the page anyway
+		}
+	}
+
+	ctx = withBreakfastID(ctx, id)
+	ctx = a.post(ctx, username, err == nil)
+
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
+
+	a.stats.served(b, getContextRegion(ctx), servedPermalink)
+
+	var (
+		buf         bytes.Buffer
+		contentType = "text/html; charset=utf-8"
+	)
+	if wantsJSON(r) {
+		contentType = "application/json; charset=utf-8"
+		encodeJSON(&buf, struct {
+			breakfast
+			Related []breakfast `json:"related,omitempty"`
+		}{b, related})
+	} else {
+		writeHTML(&buf, b, related)
+	}
+	// No Last-Modified: the page includes related breakfasts and ratings
+	// that change independently, so only the content ETag is reliable.
+	w.Header().Set("Cache-Control", permalinkCacheControl)
+	w.Header().Add("Vary", "Accept")
+	serveConditional(w, r, contentType, "", time.Time{}, buf.Bytes())
+}
+
+func (a *api) handleRateBreakfast(w http.ResponseWriter, r *http.Request) {
+	var (
+		username  = getUsername(r)
+		id, _     = strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+		rating, _ = strconv.Atoi(r.FormValue("rating"))
+	)
+
+	if username == anonymous {
+		http.Error(w, "rating requires a username", http.StatusBadRequest)
+		return
+	}
+
+	ctx := a.pre(r.Context(), a.proxies.originIP(r))
+
+	b, err := a.repo.rateBreakfast(ctx, username, id, rating)
+	if err == errBreakerOpen {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable) // fail fast, skip postprocessing
+		return
+	}
+
+	a.post(ctx, username, err == nil)
+
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, b)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writeHTML(w, b, nil)
+}
+
+// handleSetFavorite adds the breakfast in the id form value to the user's
+// favorites on POST /favorites, and removes it on DELETE /favorites/{id}.
+func (a *api) handleSetFavorite(w http.ResponseWriter, r *http.Request) {
+	var (
+		username = getUsername(r)
+		idStr    = mux.Vars(r)["id"]
+		favorite = r.Method == "POST"
+	)
+	if favorite {
+		idStr = r.FormValue("id")
+	}
+
+	if username == anonymous {
+		http.Error(w, "favorites require a username", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid breakfast ID %q", idStr), http.StatusBadRequest)
+		return
+	}
+
+	ctx := a.pre(r.Context(), a.proxies.originIP(r))
+
+	err = a.repo.setFavorite(ctx, username, id, favorite)
+	if err == errBreakerOpen {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable) // fail fast, skip postprocessing
+		return
+	}
+
+	a.post(ctx, username, err == nil)
+
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) handleGetFavorites(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+
+	if username == anonymous {
+		http.Error(w, "favorites require a username", http.StatusBadRequest)
+		return
+	}
+
+	ctx := a.pre(r.Context(), a.proxies.originIP(r))
+
+	list, err := a.repo.getFavorites(ctx, username)
+	if err == errBreakerOpen {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable) // fail fast, skip postprocessing
+		return
+	}
+
+	a.post(ctx, username, err == nil)
+
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private")
+	if wantsJSON(r) {
+		writeJSON(w, list)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writeListHTML(w, "Favorites of "+username, list)
+}
+
+func (a *api) handleToday(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+
+	loc, err := time.LoadLocation(r.URL.Query().Get("tz")) // empty means UTC
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := a.pre(r.Context(), a.proxies.originIP(r))
+
+	b, err := a.repo.getBreakfastOfTheDay(ctx, username, time.Now().In(loc))
+	if err == errBreakerOpen {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable) // fail fast, skip postprocessing
+		return
+	}
+
+	if err == nil {
+		ctx = withBreakfastID(ctx, b.ID)
+	}
+	ctx = a.post(ctx, username, err == nil)
+
+	if err != nil {
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
+
+	a.stats.served(b, getContextRegion(ctx), servedToday)
+
+	if wantsJSON(r) {
+		writeJSON(w, b)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writeHTML(w, b, nil)
+}
+
+func (a *api) handleSearch(w http.ResponseWriter, r *http.Request) {
+	var (
+		username = getUsername(r)
+		query    = strings.TrimSpace(r.URL.Query().Get("q"))
+	)
+
+	if query == "" {
+		http.Error(w, "missing query parameter q", http.StatusBadRequest)
+		return
+	}
+
+	ctx := a.pre(r.Context(), a.proxies.originIP(r))
+
+	results, err := a.search.search(ctx, query)
+
+	a.post(ctx, username, err == nil)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writeSearchHTML(w, query, results)
+}
+
+// handleUploadImage takes a multipart form with the image in the "image"
+// field, stores it under its content address, and points the breakfast at it.
+// maxUploadFraming is how much bigger than the image an upload's body may
+// be, for the multipart boundaries, headers and any other form fields.
+const maxUploadFraming = 1 << 20
+
+func (a *api) handleUploadImage(w http.ResponseWriter, r *http.Request) {
+	var (
+		username = getUsername(r)
+		id, _    = strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	)
+
+	if username == anonymous {
+		http.Error(w, "image upload requires a username", http.StatusBadRequest)
+		return
+	}
+
+	// The body is the image plus the multipart framing around it, so only
+	// reject bodies that are too big whatever the framing. The image itself
+	// is checked once it's parsed out.
+	maxBody := a.maxImage + maxUploadFraming
+	if r.ContentLength > maxBody {
+		http.Error(w, fmt.Sprintf("image larger than %d bytes", a.maxImage), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	f, _, err := r.FormFile("image")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("image larger than %d bytes", a.maxImage), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, a.maxImage+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) > a.maxImage {
+		http.Error(w, fmt.Sprintf("image larger than %d bytes", a.maxImage), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	contentType := http.DetectContentType(data) // don't trust what the client says
+	ext, ok := imageTypes[contentType]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unsupported image type %s", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+	key := imageKey(data, ext)
 
-	b, err := a.repo.getBreakfast(r.Context(), username, id)
+	ctx := a.pre(r.Context(), a.proxies.originIP(r))
+
+	// If the breakfast turns out not to exist, the image is orphaned, but
+	// it's content-addressed, so that's harmless.
+	err = a.images.putImage(ctx, key, contentType, data)
+	var b breakfast
+	if err == nil {
+		b, err = a.repo.setBreakfastImage(ctx, username, id, "/images/"+key)
+	}
+	if err == errBreakerOpen {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable) // fail fast, skip postprocessing
+		return
+	}
 
-	a.post(r.Context(), username, err == nil)
+	a.post(ctx, username, err == nil)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, err.Error(), errorCode(err))
+		return
+	}
+
+	w.Header().Set("Location", b.Image)
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, b)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	writeHTML(w, b, nil)
+}
+
+// handleGetImage serves the original image, or with ?w= and/or ?h=, a
+// downscaled variant that fits within those dimensions.
+func (a *api) handleGetImage(w http.ResponseWriter, r *http.Request) {
+	var (
+		key    = mux.Vars(r)["key"]
+		width  = r.URL.Query().Get("w")
+		height = r.URL.Query().Get("h")
+	)
+
+	if width != "" || height != "" {
+		a.handleResizeImage(w, r, key, width, height)
+		return
+	}
+
+	// Content-addressed images never change, so a client that has one
+	// doesn't need us to fetch it again.
+	if etag := imageETag(key, time.Time{}); notModified(r, etag) {
+		w.Header().Set("Cache-Control", imageCacheControlFor(key))
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rc, contentType, modTime, err := a.images.getImage(r.Context(), key)
+	if err == errImageNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Cache-Control", imageCacheControlFor(key))
+	serveConditional(w, r, contentType, imageETag(key, modTime), modTime, data)
+}
+
+func (a *api) handleResizeImage(w http.ResponseWriter, r *http.Request, key, width, height string) {
+	var wi, hi int
+	for _, p := range []struct {
+		s string
+		i *int
+	}{{width, &wi}, {height, &hi}} {
+		if p.s == "" {
+			continue
+		}
+		i, err := strconv.Atoi(p.s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		*p.i = i
+	}
+
+	var etag string
+	if contentAddressed.MatchString(key) {
+		etag = fmt.Sprintf(`"%s-%dx%d"`, key, wi, hi)
+	}
+	if notModified(r, etag) {
+		w.Header().Set("Cache-Control", imageCacheControlFor(key))
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
+	data, contentType, _, err := a.resizer.resize(r.Context(), key, wi, hi)
+	switch {
+	case err == errImageNotFound:
+		http.NotFound(w, r)
+		return
+	case err == errInvalidDimensions:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err == errImageTooLarge:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Cache-Control", imageCacheControlFor(key))
+	serveConditional(w, r, contentType, etag, time.Time{}, data)
+}
+
+// handleStats shows the most-served breakfasts since the process started.
+func (a *api) handleStats(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	if n <= 0 {
+		n = 10
+	}
+	top := a.stats.top(n)
+
+	if wantsJSON(r) {
+		writeJSON(w, top)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	writeHTML(w, b)
+	writeStatsHTML(w, top)
 }
 
 func (a *api) handleAdmin(w http.ResponseWriter, r *http.Request) {
@@ -86,33 +565,147 @@ func (a *api) handleAdmin(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, fmt.Sprintf("admin returning %d", code), code)
 }
 
+const anonymous = "<anonymous>"
+
+// errorCode maps repository errors to HTTP status codes.
+func errorCode(err error) int {
+	switch {
+	case isNotFound(err):
+		return http.StatusNotFound
+	case isClientError(err):
+		return http.StatusBadRequest
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
 func getUsername(r *http.Request) string {
 	username := r.URL.Query().Get("username")
 	if username == "" {
-		username = "<anonymous>"
+		username = anonymous
 	}
 	return username
 }
 
-func getRegion(r *http.Request) string {
-	region := r.URL.Query().Get("region")
-	if region == "" {
-		region = "??"
-	}
-	return region
+// wantsJSON reports whether the client asked for JSON rather than HTML,
+// via the Accept header or ?format=json.
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	encodeJSON(w, v)
 }
 
-func writeHTML(w io.Writer, b breakfast) {
+func encodeJSON(w io.Writer, v interface{}) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	enc.Encode(v)
+}
+
+func writeHTML(w io.Writer, b breakfast, related []breakfast) {
 	fmt.Fprintf(w, "<html><head><title>Breakfast Solutions</title>\n")
 	fmt.Fprintf(w, "<style>body { margin: 2em auto; max-width: 500px; }</style></head>\n")
 	fmt.Fprintf(w, "<h1>Breakfast Solutions</h1>\n")
 	fmt.Fprintf(w, `<h2>%s</h2>`+"\n", b.Name)
 	fmt.Fprintf(w, "<br/>\n")
-	fmt.Fprintf(w, `<img src="%s" style="max-width:500px;"/>`+"\n", b.Image)
+	fmt.Fprintf(w, `<img src="%s?w=500" srcset="%s" sizes="(max-width: 500px) 100vw, 500px" style="max-width:500px;"/>`+"\n", b.Image, srcset(b.Image))
 	fmt.Fprintf(w, "<br/>\n")
 	fmt.Fprintf(w, "<br/>\n")
 	fmt.Fprintf(w, "%s\n", b.Description)
 	fmt.Fprintf(w, "<br/>\n")
+	if details := breakfastDetails(b); details != "" {
+		fmt.Fprintf(w, "<p><small>%s</small></p>\n", details)
+	}
 	fmt.Fprintf(w, `<a href="/breakfasts/%d">Permalink</a>`+"\n", b.ID)
+	if len(related) > 0 {
+		fmt.Fprintf(w, "<h3>People who liked this also liked</h3>\n")
+		fmt.Fprintf(w, "<ul>\n")
+		for _, r := range related {
+			fmt.Fprintf(w, `<li><a href="/breakfasts/%d">%s</a></li>`+"\n", r.ID, r.Name)
+		}
+		fmt.Fprintf(w, "</ul>\n")
+	}
 	fmt.Fprintf(w, "</body></html>\n")
 }
+
+func writeListHTML(w io.Writer, title string, list []breakfast) {
+	fmt.Fprintf(w, "<html><head><title>Breakfast Solutions</title>\n")
+	fmt.Fprintf(w, "<style>body { margin: 2em auto; max-width: 500px; }</style></head>\n")
+	fmt.Fprintf(w, "<h1>Breakfast Solutions</h1>\n")
+	fmt.Fprintf(w, "<h2>%s</h2>\n", html.EscapeString(title))
+	if len(list) <= 0 {
+		fmt.Fprintf(w, "<p>No breakfasts here.</p>\n")
+	}
+	fmt.Fprintf(w, "<ul>\n")
+	for _, b := range list {
+		fmt.Fprintf(w, `<li><a href="/breakfasts/%d">%s</a>`, b.ID, b.Name)
+		if details := breakfastDetails(b); details != "" {
+			fmt.Fprintf(w, " <small>%s</small>", details)
+		}
+		fmt.Fprintf(w, "</li>\n")
+	}
+	fmt.Fprintf(w, "</ul>\n")
+	fmt.Fprintf(w, "</body></html>\n")
+}
+
+func writeStatsHTML(w io.Writer, top []popularBreakfast) {
+	fmt.Fprintf(w, "<html><head><title>Breakfast Solutions</title>\n")
+	fmt.Fprintf(w, "<style>body { margin: 2em auto; max-width: 500px; }</style></head>\n")
+	fmt.Fprintf(w, "<h1>Breakfast Solutions</h1>\n")
+	fmt.Fprintf(w, "<h2>Top breakfasts</h2>\n")
+	if len(top) <= 0 {
+		fmt.Fprintf(w, "<p>No breakfasts served yet.</p>\n")
+	}
+	fmt.Fprintf(w, "<ol>\n")
+	for _, p := range top {
+		fmt.Fprintf(w, `<li><a href="/breakfasts/%d">%s</a> <small>served %d times</small></li>`+"\n", p.ID, html.EscapeString(p.Name), p.Served)
+	}
+	fmt.Fprintf(w, "</ol>\n")
+	fmt.Fprintf(w, "</body></html>\n")
+}
+
+func writeSearchHTML(w io.Writer, query string, results []searchResult) {
+	fmt.Fprintf(w, "<html><head><title>Breakfast Solutions</title>\n")
+	fmt.Fprintf(w, "<style>body { margin: 2em auto; max-width: 500px; }</style></head>\n")
+	fmt.Fprintf(w, "<h1>Breakfast Solutions</h1>\n")
+	fmt.Fprintf(w, "<h2>Results for &ldquo;%s&rdquo;</h2>\n", html.EscapeString(query))
+	if len(results) <= 0 {
+		fmt.Fprintf(w, "<p>No breakfasts found.</p>\n")
+	}
+	fmt.Fprintf(w, "<ol>\n")
+	for _, res := range results {
+		fmt.Fprintf(w, `<li><a href="/breakfasts/%d">%s</a> <small>%s</small></li>`+"\n", res.ID, res.Name, res.Description)
+	}
+	fmt.Fprintf(w, "</ol>\n")
+	fmt.Fprintf(w, "</body></html>\n")
+}
+
+// srcset offers the browser a few pre-sized variants of the image, so it
+// needn't fetch the full-size original.
+func srcset(image string) string {
+	var variants []string
+	for _, w := range imageSrcsetWidths {
+		variants = append(variants, fmt.Sprintf("%s?w=%d %dw", image, w, w))
+	}
+	return strings.Join(variants, ", ")
+}
+
+// breakfastDetails summarizes the optional breakfast fields, if any are set.
+func breakfastDetails(b breakfast) string {
+	var details []string
+	if b.RatingCount > 0 {
+		details = append(details, fmt.Sprintf("&#9733; %.1f (%d)", b.AverageRating, b.RatingCount))
+	}
+	if b.Cuisine != "" {
+		details = append(details, b.Cuisine)
+	}
+	if b.Calories > 0 {
+		details = append(details, fmt.Sprintf("%d kcal", b.Calories))
+	}
+	if len(b.Tags) > 0 {
+		details = append(details, strings.Join(b.Tags, ", "))
+	}
+	return strings.Join(details, " &middot; ")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// auditEvent records a breakfast being served, for downstream analytics.
+type auditEvent struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	Username    string    `json:"username"`
+	BreakfastID uint64    `json:"breakfast_id"`
+	Region      string    `json:"region"`
+	Success     bool      `json:"success"`
+	TraceID     string    `json:"trace_id,omitempty"`
+}
+
+// auditSink delivers batches of events somewhere durable.
+type auditSink interface {
+	publish(ctx context.Context, events []auditEvent) error
+	Close() error
+}
+
+const (
+	auditBatchSize     = 100
+	auditFlushInterval = time.Second
+)
+
+// auditPublisher delivers events to a sink in the background, so requests
+// never wait on it. The queue is bounded: when the sink falls behind, new
+// events are dropped and counted rather than piling up in memory.
+type auditPublisher struct {
+	sink   auditSink
+	queue  chan auditEvent
+	quit   chan struct{}
+	done   chan struct{}
+	events *prometheus.CounterVec // by result
+	logger log.Logger
+}
+
+func newAuditPublisher(sink auditSink, queueSize int, events *prometheus.CounterVec, logger log.Logger) *auditPublisher {
+	return &auditPublisher{
+		sink:   sink,
+		queue:  make(chan auditEvent, queueSize),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+		events: events,
+		logger: logger,
+	}
+}
+
+func (p *auditPublisher) enqueue(ev auditEvent) {
+	select {
+	case p.queue <- ev:
+	default:
+		p.events.WithLabelValues("dropped").Inc()
+	}
+}
+
+// run delivers events until stop is called, then delivers what's left in
+// the queue and closes the sink.
+func (p *auditPublisher) run() error {
+	defer close(p.done)
+	defer p.sink.Close()
+
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]auditEvent, 0, auditBatchSize)
+	for {
+		select {
+		case ev := <-p.queue:
+			if batch = append(batch, ev); len(batch) >= auditBatchSize {
+				batch = p.flush(batch)
+			}
+		case <-ticker.C:
+			batch = p.flush(batch)
+		case <-p.quit:
+			for {
+				select {
+				case ev := <-p.queue:
+					if batch = append(batch, ev); len(batch) >= auditBatchSize {
+						batch = p.flush(batch)
+					}
+				default:
+					p.flush(batch)
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (p *auditPublisher) stop() {
+	close(p.quit)
+	<-p.done
+}
+
+func (p *auditPublisher) flush(batch []auditEvent) []auditEvent {
+	if len(batch) == 0 {
+		return batch
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.sink.publish(ctx, batch); err != nil {
+		level.Warn(p.logger).Log("component", "audit", "events", len(batch), "err", err)
+		p.events.WithLabelValues("failed").Add(float64(len(batch)))
+	} else {
+		p.events.WithLabelValues("published").Add(float64(len(batch)))
+	}
+	return batch[:0]
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAuditPublisherBatchesAndDrainsOnStop(t *testing.T) {
+	sink := &recordingSink{}
+	p, events := newTestAuditPublisher(sink, 1000)
+	for i := 0; i < 250; i++ {
+		p.enqueue(auditEvent{BreakfastID: uint64(i)})
+	}
+
+	go p.run()
+	p.stop()
+
+	sizes := sink.batchSizes()
+	if want := []int{100, 100, 50}; !equalInts(sizes, want) {
+		t.Errorf("batch sizes: have %v, want %v", sizes, want)
+	}
+	var next uint64
+	for _, batch := range sink.batches {
+		for _, ev := range batch {
+			if ev.BreakfastID != next {
+				t.Fatalf("have event %d, want %d: events out of order", ev.BreakfastID, next)
+			}
+			next++
+		}
+	}
+	if have := testutil.ToFloat64(events.WithLabelValues("published")); have != 250 {
+		t.Errorf("published: have %v, want 250", have)
+	}
+	if !sink.closed {
+		t.Errorf("sink wasn't closed on stop")
+	}
+}
+
+func TestAuditPublisherDropsWhenQueueIsFull(t *testing.T) {
+	sink := &recordingSink{}
+	p, events := newTestAuditPublisher(sink, 2)
+	for i := 0; i < 5; i++ {
+		p.enqueue(auditEvent{BreakfastID: uint64(i)})
+	}
+	if have := testutil.ToFloat64(events.WithLabelValues("dropped")); have != 3 {
+		t.Errorf("dropped: have %v, want 3", have)
+	}
+
+	go p.run()
+	p.stop()
+
+	if sizes, want := sink.batchSizes(), []int{2}; !equalInts(sizes, want) {
+		t.Errorf("batch sizes: have %v, want %v", sizes, want)
+	}
+	if have := testutil.ToFloat64(events.WithLabelValues("published")); have != 2 {
+		t.Errorf("published: have %v, want 2", have)
+	}
+}
+
+func TestAuditPublisherCountsFailures(t *testing.T) {
+	sink := &recordingSink{err: errors.New("sink unavailable")}
+	p, events := newTestAuditPublisher(sink, 10)
+	for i := 0; i < 3; i++ {
+		p.enqueue(auditEvent{})
+	}
+
+	go p.run()
+	p.stop()
+
+	if have := testutil.ToFloat64(events.WithLabelValues("failed")); have != 3 {
+		t.Errorf("failed: have %v, want 3", have)
+	}
+	if have := testutil.ToFloat64(events.WithLabelValues("published")); have != 0 {
+		t.Errorf("published: have %v, want 0", have)
+	}
+}
+
+func newTestAuditPublisher(sink auditSink, queueSize int) (*auditPublisher, *prometheus.CounterVec) {
+	events := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "events_total"}, []string{"result"})
+	return newAuditPublisher(sink, queueSize, events, log.NewNopLogger()), events
+}
+
+// recordingSink is an auditSink that keeps the batches it's given.
+type recordingSink struct {
+	mtx     sync.Mutex
+	batches [][]auditEvent
+	err     error // returned by publish, if set
+	closed  bool
+}
+
+func (s *recordingSink) publish(ctx context.Context, events []auditEvent) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.batches = append(s.batches, append([]auditEvent(nil), events...)) // the publisher reuses events
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *recordingSink) batchSizes() []int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var sizes []int
+	for _, batch := range s.batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
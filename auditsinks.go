@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// newAuditSink returns the sink for the URL:
+//
+//	file:///var/log/breakfast-audit.jsonl, or just a path
+//	nats://[user:pass@]localhost:4222/breakfast.served
+//	kafka+http://localhost:8082/breakfast-served
+//
+// Kafka is reached through a REST proxy speaking the Confluent v2 API, as
+// provided by Confluent REST Proxy and by Redpanda.
+func newAuditSink(rawurl string) (auditSink, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "", "file":
+		return newFileAuditSink(u.Path)
+	case "nats":
+		return newNATSAuditSink(u)
+	case "kafka+http", "kafka+https":
+		return newKafkaAuditSink(u)
+	default:
+		return nil, fmt.Errorf("unsupported audit sink scheme %q", u.Scheme)
+	}
+}
+
+//
+//
+//
+
+// fileAuditSink appends events to a file, one JSON object per line.
+type fileAuditSink struct {
+	f *os.File
+}
+
+func newFileAuditSink(filename string) (*fileAuditSink, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("audit file path is required")
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAuditSink{f}, nil
+}
+
+func (s *fileAuditSink) publish(ctx context.Context, events []auditEvent) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+	if _, err := s.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *fileAuditSink) Close() error {
+	return s.f.Close()
+}
+
+//
+//
+//
+
+// natsAuditSink publishes each event as a message on a NATS subject. It
+// speaks just enough of the NATS client protocol to publish, and confirms
+// each batch with a PING, so errors from the server aren't lost. Each batch
+// is sent at most once: if it fails partway, some of its events may still
+// have been delivered, and resending could duplicate them. It isn't safe
+// for concurrent use; the auditPublisher calls it from one goroutine.
+type natsAuditSink struct {
+	addr     string
+	subject  string
+	user     string
+	password string
+	conn     net.Conn
+	r        *bufio.Reader
+}
+
+func newNATSAuditSink(u *url.URL) (*natsAuditSink, error) {
+	subject := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || subject == "" {
+		return nil, fmt.Errorf("NATS audit sink %q must be nats://host:port/subject", u.String())
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	password, _ := u.User.Password()
+	return &natsAuditSink{
+		addr:     host,
+		subject:  subject,
+		user:     u.User.Username(),
+		password: password,
+	}, nil
+}
+
+func (s *natsAuditSink) publish(ctx context.Context, events []auditEvent) error {
+	var buf bytes.Buffer
+	for _, ev := range events {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "PUB %s %d\r\n%s\r\n", s.subject, len(data), data)
+	}
+	buf.WriteString("PING\r\n")
+
+	// The server drops connections that stay idle too long between batches.
+	// Check a reused connection before sending anything on it, and reconnect
+	// if it's gone, rather than retrying the batch.
+	if s.conn != nil {
+		s.send(ctx, []byte("PING\r\n")) // on error, send closes the connection
+	}
+	return s.send(ctx, buf.Bytes())
+}
+
+func (s *natsAuditSink) send(ctx context.Context, p []byte) error {
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetDeadline(deadline)
+	}
+	if _, err := s.conn.Write(p); err != nil {
+		s.Close()
+		return err
+	}
+	if err := s.awaitPong(); err != nil {
+		s.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *natsAuditSink) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		s.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		s.Close()
+		return fmt.Errorf("NATS server sent %q, want INFO", strings.TrimSpace(line))
+	}
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "breakfast-solutions",
+		"lang":     "go",
+		"version":  version,
+	}
+	if s.user != "" {
+		options["user"], options["pass"] = s.user, s.password
+	}
+	data, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", data); err != nil {
+		s.Close()
+		return err
+	}
+	return nil
+}
+
+// awaitPong reads until the server answers our PING, answering its PINGs
+// along the way.
+func (s *natsAuditSink) awaitPong() error {
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func (s *natsAuditSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn, s.r = nil, nil
+	return err
+}
+
+//
+//
+//
+
+// kafkaAuditSink produces events to a Kafka topic through a REST proxy,
+// one request per batch.
+type kafkaAuditSink struct {
+	topicURL string
+	client   *http.Client
+}
+
+func newKafkaAuditSink(u *url.URL) (*kafkaAuditSink, error) {
+	topic := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || topic == "" || strings.Contains(topic, "/") {
+		return nil, fmt.Errorf("Kafka audit sink %q must be kafka+http://host:port/topic", u.String())
+	}
+	proxy := url.URL{
+		Scheme: strings.TrimPrefix(u.Scheme, "kafka+"),
+		User:   u.User,
+		Host:   u.Host,
+		Path:   "/topics/" + topic,
+	}
+	return &kafkaAuditSink{
+		topicURL: proxy.String(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *kafkaAuditSink) publish(ctx context.Context, events []auditEvent) error {
+	type record struct {
+		Value auditEvent `json:"value"`
+	}
+	var body struct {
+		Records []record `json:"records"`
+	}
+	for _, ev := range events {
+		body.Records = append(body.Records, record{ev})
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.topicURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Kafka REST proxy: %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	// The proxy reports per-record failures in a 200 response.
+	var result struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return fmt.Errorf("Kafka REST proxy: %v", err)
+	}
+	for _, o := range result.Offsets {
+		if o.ErrorCode != nil || o.Error != "" {
+			return fmt.Errorf("Kafka REST proxy: record not produced: %s", o.Error)
+		}
+	}
+	return nil
+}
+
+func (s *kafkaAuditSink) Close() error {
+	return nil
+}
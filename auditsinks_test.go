@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNATSAuditSinkPublish(t *testing.T) {
+	server := newFakeNATS(t)
+	sink := newTestNATSAuditSink(t, "nats://alice:secret@"+server.addr()+"/breakfast.served")
+	defer sink.Close()
+
+	if err := sink.publish(testContext(t), testEvents(0, 3)); err != nil {
+		t.Fatal(err)
+	}
+	server.wantEvents(t, 0, 1, 2)
+	if have := server.connectOption("user"); have != "alice" {
+		t.Errorf("CONNECT user: have %v, want alice", have)
+	}
+}
+
+func TestNATSAuditSinkReconnectsWhenStale(t *testing.T) {
+	server := newFakeNATS(t)
+	sink := newTestNATSAuditSink(t, "nats://"+server.addr()+"/breakfast.served")
+	defer sink.Close()
+
+	if err := sink.publish(testContext(t), testEvents(0, 2)); err != nil {
+		t.Fatal(err)
+	}
+	server.hangUp() // e.g. an idle timeout between batches
+	if err := sink.publish(testContext(t), testEvents(2, 2)); err != nil {
+		t.Fatalf("after the server hung up: %v", err)
+	}
+	server.wantEvents(t, 0, 1, 2, 3)
+	if have := server.connections(); have != 2 {
+		t.Errorf("connections: have %d, want 2", have)
+	}
+}
+
+func TestNATSAuditSinkDoesntResendBatches(t *testing.T) {
+	server := newFakeNATS(t)
+	sink := newTestNATSAuditSink(t, "nats://"+server.addr()+"/breakfast.served")
+	defer sink.Close()
+
+	if err := sink.publish(testContext(t), testEvents(0, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server takes the messages, but hangs up before confirming them.
+	server.setHangUpOnPing(true)
+	if err := sink.publish(testContext(t), testEvents(1, 2)); err == nil {
+		t.Fatalf("want an error when the batch isn't confirmed")
+	}
+	server.wantEvents(t, 0, 1, 2)
+}
+
+func TestNATSAuditSinkServerError(t *testing.T) {
+	server := newFakeNATS(t)
+	server.setReplyToPing("-ERR 'Permissions Violation for Publish to breakfast.served'")
+	sink := newTestNATSAuditSink(t, "nats://"+server.addr()+"/breakfast.served")
+	defer sink.Close()
+
+	err := sink.publish(testContext(t), testEvents(0, 1))
+	if err == nil || !strings.Contains(err.Error(), "Permissions Violation") {
+		t.Errorf("have %v, want the server's error", err)
+	}
+}
+
+func TestKafkaAuditSinkPublish(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		produced []auditEvent
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/topics/breakfast-served" {
+			http.Error(w, "unexpected "+r.Method+" "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+		if have, want := r.Header.Get("Content-Type"), "application/vnd.kafka.json.v2+json"; have != want {
+			http.Error(w, "unexpected content type "+have, http.StatusUnsupportedMediaType)
+			return
+		}
+		var body struct {
+			Records []struct {
+				Value auditEvent `json:"value"`
+			} `json:"records"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var offsets []string
+		mtx.Lock()
+		for _, record := range body.Records {
+			offsets = append(offsets, fmt.Sprintf(`{"partition":0,"offset":%d}`, len(produced)))
+			produced = append(produced, record.Value)
+		}
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "application/vnd.kafka.v2+json")
+		fmt.Fprintf(w, `{"offsets":[%s]}`, strings.Join(offsets, ","))
+	}))
+	defer server.Close()
+
+	sink := newTestKafkaAuditSink(t, "kafka+"+server.URL+"/breakfast-served")
+	if err := sink.publish(testContext(t), testEvents(0, 3)); err != nil {
+		t.Fatal(err)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(produced) != 3 {
+		t.Fatalf("produced %d records, want 3", len(produced))
+	}
+	for i, ev := range produced {
+		if ev.BreakfastID != uint64(i) {
+			t.Errorf("record %d: have breakfast %d, want %d", i, ev.BreakfastID, i)
+		}
+	}
+}
+
+func TestKafkaAuditSinkErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"status", http.StatusInternalServerError, `{"error_code":50001,"message":"broker unavailable"}`, "broker unavailable"},
+		{"record", http.StatusOK, `{"offsets":[{"partition":0,"offset":0},{"error_code":2,"error":"record too large"}]}`, "record too large"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			}))
+			defer server.Close()
+
+			sink := newTestKafkaAuditSink(t, "kafka+"+server.URL+"/breakfast-served")
+			err := sink.publish(testContext(t), testEvents(0, 2))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("have %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// testEvents returns n events, for breakfast IDs from first.
+func testEvents(first, n int) []auditEvent {
+	var events []auditEvent
+	for i := first; i < first+n; i++ {
+		events = append(events, auditEvent{Type: "served", BreakfastID: uint64(i), Region: unknownRegion, Success: true})
+	}
+	return events
+}
+
+func newTestNATSAuditSink(t *testing.T, rawurl string) *natsAuditSink {
+	t.Helper()
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := newNATSAuditSink(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func newTestKafkaAuditSink(t *testing.T, rawurl string) *kafkaAuditSink {
+	t.Helper()
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := newKafkaAuditSink(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+// fakeNATS is a stand-in for a NATS server. It speaks the part of the
+// client protocol the sink uses, and keeps the messages it's sent.
+type fakeNATS struct {
+	ln net.Listener
+
+	mtx          sync.Mutex
+	conns        []net.Conn
+	connected    map[string]interface{} // the last CONNECT options
+	messages     [][]byte
+	hangUpOnPing bool
+	replyToPing  string
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeNATS{ln: ln, replyToPing: "PONG"}
+	t.Cleanup(func() { ln.Close(); f.hangUp() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mtx.Lock()
+			f.conns = append(f.conns, conn)
+			f.mtx.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeNATS) addr() string { return f.ln.Addr().String() }
+
+func (f *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"max_payload\":1048576}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "CONNECT":
+			var options map[string]interface{}
+			json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "CONNECT ")), &options)
+			f.mtx.Lock()
+			f.connected = options
+			f.mtx.Unlock()
+		case "PUB":
+			n, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, n+2) // and \r\n
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			f.mtx.Lock()
+			f.messages = append(f.messages, payload[:n])
+			f.mtx.Unlock()
+		case "PING":
+			f.mtx.Lock()
+			hangUp, reply := f.hangUpOnPing, f.replyToPing
+			f.mtx.Unlock()
+			if hangUp {
+				return
+			}
+			fmt.Fprintf(conn, "%s\r\n", reply)
+		}
+	}
+}
+
+// hangUp closes the server's end of every connection.
+func (f *fakeNATS) hangUp() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakeNATS) setHangUpOnPing(hangUp bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.hangUpOnPing = hangUp
+}
+
+func (f *fakeNATS) setReplyToPing(reply string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.replyToPing = reply
+}
+
+func (f *fakeNATS) connections() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return len(f.conns)
+}
+
+func (f *fakeNATS) connectOption(key string) interface{} {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.connected[key]
+}
+
+// wantEvents checks that exactly the events for the breakfast IDs were
+// received, in order.
+func (f *fakeNATS) wantEvents(t *testing.T, ids ...uint64) {
+	t.Helper()
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	var have []uint64
+	for _, msg := range f.messages {
+		var ev auditEvent
+		if err := json.Unmarshal(msg, &ev); err != nil {
+			t.Fatalf("message %q: %v", msg, err)
+		}
+		have = append(have, ev.BreakfastID)
+	}
+	if fmt.Sprint(have) != fmt.Sprint(ids) {
+		t.Errorf("events: have %v, want %v", have, ids)
+	}
+}
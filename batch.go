@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// batchCmd makes a subcommand for a short-lived job. The job would exit
+// before Prometheus could scrape it, so with -push.gateway its metrics are
+// pushed to a Pushgateway when it's done, grouped under the job name. Jobs
+// register their own flags on fs before parsing args, and their metrics
+// with auto.
+//
+// A successful run replaces the job's metrics in the Pushgateway. A failed
+// run only adds to them, and doesn't include last_success_timestamp_seconds,
+// so the time of the last success survives failures.
+func batchCmd(job string, run func(fs *flag.FlagSet, args []string, auto promauto.Factory) error) func([]string) error {
+	return func(args []string) error {
+		var (
+			fs       = flag.NewFlagSet(job, flag.ExitOnError)
+			gateway  = fs.String("push.gateway", "", "Pushgateway URL to push metrics to at exit, e.g. http://localhost:9091 (empty disables)")
+			registry = newRegistry()
+			auto     = promauto.With(registry)
+		)
+		var (
+			duration = auto.NewGauge(prometheus.GaugeOpts{
+				Namespace: "breakfast_solutions",
+				Subsystem: "batch",
+				Name:      "duration_seconds",
+				Help:      "How long the last run of the job took.",
+			})
+			lastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{ // registered on success
+				Namespace: "breakfast_solutions",
+				Subsystem: "batch",
+				Name:      "last_success_timestamp_seconds",
+				Help:      "When the job last completed successfully, as a Unix timestamp.",
+			})
+		)
+
+		begin := time.Now()
+		err := run(fs, args, auto)
+		duration.Set(time.Since(begin).Seconds())
+		if err == nil {
+			lastSuccess.SetToCurrentTime()
+			registry.MustRegister(lastSuccess)
+		}
+
+		if *gateway != "" {
+			pusher := push.New(*gateway, job).Gatherer(registry)
+			pushFn := pusher.Push
+			if err != nil {
+				pushFn = pusher.Add
+			}
+			if pushErr := pushFn(); pushErr != nil && err == nil {
+				err = pushErr
+			}
+		}
+		return err
+	}
+}
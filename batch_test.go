@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestBatchCmdPushesOnSuccess(t *testing.T) {
+	gateway := newFakePushgateway()
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	cmd := batchCmd("testjob", func(fs *flag.FlagSet, args []string, auto promauto.Factory) error {
+		processed := auto.NewCounter(prometheus.CounterOpts{
+			Namespace: "breakfast_solutions",
+			Subsystem: "testjob",
+			Name:      "processed_total",
+			Help:      "Things processed.",
+		})
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		processed.Add(3)
+		return nil
+	})
+	if err := cmd([]string{"-push.gateway", server.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	push := gateway.only(t)
+	if want := "PUT /metrics/job/testjob"; push.request != want {
+		t.Errorf("request: have %q, want %q", push.request, want)
+	}
+	for _, name := range []string{
+		"breakfast_solutions_build_info",
+		"breakfast_solutions_batch_duration_seconds",
+		"breakfast_solutions_batch_last_success_timestamp_seconds",
+		"breakfast_solutions_testjob_processed_total",
+	} {
+		if _, ok := push.families[name]; !ok {
+			t.Errorf("%s wasn't pushed; have %v", name, push.names())
+		}
+	}
+	if have := push.families["breakfast_solutions_testjob_processed_total"].GetMetric()[0].GetCounter().GetValue(); have != 3 {
+		t.Errorf("processed_total: have %v, want 3", have)
+	}
+}
+
+func TestBatchCmdPushesOnFailure(t *testing.T) {
+	gateway := newFakePushgateway()
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	failure := errors.New("job failed")
+	cmd := batchCmd("testjob", func(fs *flag.FlagSet, args []string, auto promauto.Factory) error {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err := cmd([]string{"-push.gateway", server.URL}); err != failure {
+		t.Fatalf("have %v, want %v", err, failure)
+	}
+
+	// POST, so the last success timestamp from an earlier run survives.
+	push := gateway.only(t)
+	if want := "POST /metrics/job/testjob"; push.request != want {
+		t.Errorf("request: have %q, want %q", push.request, want)
+	}
+	if _, ok := push.families["breakfast_solutions_batch_duration_seconds"]; !ok {
+		t.Errorf("duration wasn't pushed; have %v", push.names())
+	}
+	if _, ok := push.families["breakfast_solutions_batch_last_success_timestamp_seconds"]; ok {
+		t.Errorf("last success timestamp was pushed for a failed run")
+	}
+}
+
+func TestBatchCmdPushError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	cmd := batchCmd("testjob", func(fs *flag.FlagSet, args []string, auto promauto.Factory) error {
+		return fs.Parse(args)
+	})
+	if err := cmd([]string{"-push.gateway", server.URL}); err == nil {
+		t.Errorf("want the push error to be returned")
+	}
+}
+
+// fakePushgateway records the metric families of each push it receives.
+type fakePushgateway struct {
+	mtx    sync.Mutex
+	pushes []fakePush
+}
+
+type fakePush struct {
+	request  string // e.g. PUT /metrics/job/x
+	families map[string]*dto.MetricFamily
+}
+
+func newFakePushgateway() *fakePushgateway {
+	return &fakePushgateway{}
+}
+
+func (g *fakePushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	push := fakePush{
+		request:  r.Method + " " + r.URL.Path,
+		families: map[string]*dto.MetricFamily{},
+	}
+	dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+	for {
+		var mf dto.MetricFamily
+		if err := dec.Decode(&mf); err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		push.families[mf.GetName()] = &mf
+	}
+
+	g.mtx.Lock()
+	g.pushes = append(g.pushes, push)
+	g.mtx.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// only returns the single push received, failing the test otherwise.
+func (g *fakePushgateway) only(t *testing.T) fakePush {
+	t.Helper()
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if len(g.pushes) != 1 {
+		t.Fatalf("want 1 push, have %d", len(g.pushes))
+	}
+	return g.pushes[0]
+}
+
+func (p fakePush) names() string {
+	var names []string
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errBreakerOpen = errors.New("circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+type breakerConfig struct {
+	failures int           // consecutive failures that open the breaker
+	timeout  time.Duration // how long to stay open before probing
+	probes   int           // successful probes required to close again
+}
+
+// breakerRepoMiddleware fails fast with errBreakerOpen when the wrapped
+// repository has been failing, rather than sending every request through
+// the slow failure path.
+type breakerRepoMiddleware struct {
+	next repository
+	b    *breaker
+}
+
+func newBreakerRepoMiddleware(next repository, cfg breakerConfig, state prometheus.Gauge, logger log.Logger) breakerRepoMiddleware {
+	state.Set(float64(breakerClosed))
+	return breakerRepoMiddleware{
+		next: next,
+		b:    &breaker{cfg: cfg, gauge: state, logger: logger},
+	}
+}
+
+func (m breakerRepoMiddleware) getBreakfast(ctx context.Context, username string, breakfastID uint64) (b breakfast, err error) {
+	gen, err := m.b.allow()
+	if err != nil {
+		return breakfast{}, err
+	}
+	defer func() { m.b.done(gen, err) }()
+	return m.next.getBreakfast(ctx, username, breakfastID)
+}
+
+func (m breakerRepoMiddleware) listBreakfasts(ctx context.Context, username string, f breakfastFilter) (a []breakfast, err error) {
+	gen, err := m.b.allow()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { m.b.done(gen, err) }()
+	return m.next.listBreakfasts(ctx, username, f)
+}
+
+func (m breakerRepoMiddleware) getRandomBreakfast(ctx context.Context, username string, q randomQuery) (b breakfast, reason choiceReason, err error) {
+	gen, err := m.b.allow()
+	if err != nil {
+		return breakfast{}, "", err
+	}
+	defer func() { m.b.done(gen, err) }()
+	return m.next.getRandomBreakfast(ctx, username, q)
+}
+
+func (m breakerRepoMiddleware) getBreakfastOfTheDay(ctx context.Context, username string, t time.Time) (b breakfast, err error) {
+	gen, err := m.b.allow()
+	if err != nil {
+		return breakfast{}, err
+	}
+	defer func() { m.b.done(gen, err) }()
+	return m.next.getBreakfastOfTheDay(ctx, username, t)
+}
+
+func (m breakerRepoMiddleware) rateBreakfast(ctx context.Context, username string, breakfastID uint64, rating int) (b breakfast, err error) {
+	gen, err := m.b.allow()
+	if err != nil {
+		return breakfast{}, err
+	}
+	defer func() { m.b.done(gen, err) }()
+	return m.next.rateBreakfast(ctx, username, breakfastID, rating)
+}
+
+func (m breakerRepoMiddleware) setFavorite(ctx context.Context, username string, breakfastID uint64, favorite bool) (err error) {
+	gen, err := m.b.allow()
+	if err != nil {
+		return err
+	}
+	defer func() { m.b.done(gen, err) }()
+	return m.next.setFavorite(ctx, username, breakfastID, favorite)
+}
+
+func (m breakerRepoMiddleware) getFavorites(ctx context.Context, username string) (a []breakfast, err error) {
+	gen, err := m.b.allow()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { m.b.done(gen, err) }()
+	return m.next.getFavorites(ctx, username)
+}
+
+func (m breakerRepoMiddleware) getRelatedBreakfasts(ctx context.Context, username string, breakfastID uint64) (a []breakfast, err error) {
+	gen, err := m.b.allow()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { m.b.done(gen, err) }()
+	return m.next.getRelatedBreakfasts(ctx, username, breakfastID)
+}
+
+func (m breakerRepoMiddleware) setBreakfastImage(ctx context.Context, username string, breakfastID uint64, image string) (b breakfast, err error) {
+	gen, err := m.b.allow()
+	if err != nil {
+		return breakfast{}, err
+	}
+	defer func() { m.b.done(gen, err) }()
+	return m.next.setBreakfastImage(ctx, username, breakfastID, image)
+}
+
+//
+//
+//
+
+type breaker struct {
+	cfg    breakerConfig
+	gauge  prometheus.Gauge
+	logger log.Logger
+
+	mtx       sync.Mutex
+	state     breakerState
+	failures  int       // consecutive, while closed
+	successes int       // probe successes, while half-open
+	probing   int       // probes in flight, while half-open
+	openedAt  time.Time // while open
+	gen       uint64    // bumped on every transition
+}
+
+// allow returns the generation the call was admitted in, so that results
+// reported via done after a transition don't count against the new state.
+func (b *breaker) allow() (uint64, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.cfg.timeout {
+		b.transition(breakerHalfOpen)
+	}
+
+	switch b.state {
+	case breakerOpen:
+		return b.gen, errBreakerOpen
+	case breakerHalfOpen:
+		if b.probing >= b.cfg.probes {
+			return b.gen, errBreakerOpen
+		}
+		b.probing++
+	}
+	return b.gen, nil
+}
+
+func (b *breaker) done(gen uint64, err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if gen != b.gen {
+		return
+	}
+
+	failed := err != nil && !isClientError(err) // e.g. a missing breakfast isn't a broken repository
+
+	switch b.state {
+	case breakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.cfg.failures {
+			b.transition(breakerOpen)
+		}
+
+	case breakerHalfOpen:
+		b.probing--
+		if failed {
+			b.transition(breakerOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.probes {
+			b.transition(breakerClosed)
+		}
+	}
+}
+
+func (b *breaker) transition(to breakerState) {
+	level.Info(b.logger).Log("component", "breaker", "from", b.state, "to", to, "failures", b.failures)
+	b.state = to
+	b.failures, b.successes, b.probing = 0, 0, 0
+	b.gen++
+	if to == breakerOpen {
+		b.openedAt = time.Now()
+	}
+	b.gauge.Set(float64(to))
+}
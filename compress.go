@@ -0,0 +1,157 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// brotliQuality trades some compression ratio for speed, since responses
+// are compressed on the fly; the default of 6 costs noticeably more CPU.
+const brotliQuality = 4
+
+// compressors are the content codings we can produce, in order of
+// preference when a client accepts several equally.
+var compressors = []struct {
+	encoding  string
+	newWriter func(io.Writer) io.WriteCloser
+}{
+	{"br", func(w io.Writer) io.WriteCloser { return brotli.NewWriterLevel(w, brotliQuality) }},
+	{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+}
+
+// compressibleTypes are the media types worth compressing. Images other
+// than SVG are already compressed, so they're sent as-is.
+var compressibleTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
+
+// compressAPIMiddleware compresses responses with the best content coding
+// the client accepts. It reports the encoding and the uncompressed size to
+// the context logger; the logging middleware counts what went on the wire.
+func compressAPIMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressingWriter{ResponseWriter: w, r: r, encoding: negotiateEncoding(r.Header.Get("Accept-Encoding"))}
+		next.ServeHTTP(cw, r)
+		cw.close()
+		if cw.enc != nil {
+			getContextLogger(r.Context()).add(
+				"http_resp_encoding", cw.encoding,
+				"http_resp_uncompressed_size", cw.count,
+			)
+		}
+	})
+}
+
+// negotiateEncoding picks the most preferred supported coding from an
+// Accept-Encoding header, or "" for identity.
+func negotiateEncoding(acceptEncoding string) string {
+	var (
+		best  string
+		bestQ float64
+		q     = map[string]float64{}
+	)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		weight := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					weight = f
+				}
+			}
+		}
+		q[coding] = weight
+	}
+	for _, c := range compressors {
+		weight, ok := q[c.encoding]
+		if !ok {
+			weight, ok = q["*"]
+		}
+		if ok && weight > bestQ {
+			best, bestQ = c.encoding, weight
+		}
+	}
+	return best
+}
+
+// compressingWriter decides whether to compress when the status code is
+// written, because only then are the response headers final.
+type compressingWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	encoding string         // negotiated, "" for identity
+	enc      io.WriteCloser // nil unless compressing
+	decided  bool
+	count    int // uncompressed bytes
+}
+
+func (cw *compressingWriter) WriteHeader(code int) {
+	if !cw.decided {
+		cw.decide(code)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressingWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	cw.count += len(p)
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *compressingWriter) decide(code int) {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" || !compressible(h.Get("Content-Type")) {
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if cw.encoding == "" {
+		return
+	}
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag) // the bytes differ, but the content doesn't
+	}
+	if cw.r.Method == "HEAD" || code < 200 || code == http.StatusNoContent || code == http.StatusPartialContent || code == http.StatusNotModified {
+		return
+	}
+	for _, c := range compressors {
+		if c.encoding == cw.encoding {
+			cw.enc = c.newWriter(cw.ResponseWriter)
+		}
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", cw.encoding)
+}
+
+func (cw *compressingWriter) close() {
+	if cw.enc != nil {
+		cw.enc.Close()
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	permalinkCacheControl = "public, max-age=3600"                // ratings and related breakfasts may change
+	imageCacheControl     = "public, max-age=86400"               // hand-placed images may be replaced
+	immutableCacheControl = "public, max-age=31536000, immutable" // content-addressed, see imageKey
+)
+
+var contentAddressed = regexp.MustCompile(`^[0-9a-f]{64}\.[a-z]+$`)
+
+// imageCacheControlFor picks the Cache-Control for an image key.
+func imageCacheControlFor(key string) string {
+	if contentAddressed.MatchString(key) {
+		return immutableCacheControl
+	}
+	return imageCacheControl
+}
+
+// imageETag returns a strong ETag for an image that doesn't require reading
+// it: content-addressed keys identify their content, and other keys are
+// qualified by their modification time. It returns "" if neither applies.
+func imageETag(key string, modTime time.Time) string {
+	switch {
+	case contentAddressed.MatchString(key):
+		return `"` + key + `"`
+	case !modTime.IsZero():
+		return fmt.Sprintf(`"%s-%x"`, key, modTime.UnixNano())
+	default:
+		return ""
+	}
+}
+
+// notModified reports whether the request's If-None-Match matches etag, in
+// which case the client already has the content.
+func notModified(r *http.Request, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveConditional writes body with the given strong ETag, or one derived
+// from its content if etag is empty, and a Last-Modified of modTime unless
+// that's zero. Requests with a matching If-None-Match, or a satisfied
+// If-Modified-Since, get a 304 Not Modified instead.
+func serveConditional(w http.ResponseWriter, r *http.Request, contentType, etag string, modTime time.Time, body []byte) {
+	if etag == "" {
+		sum := sha256.Sum256(body)
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(body))
+}
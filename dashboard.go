@@ -0,0 +1,244 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/gorilla/mux"
+)
+
+// dashboardComponents are the instrumented components, in the order they
+// appear on the dashboard, with the operations each reports. Operations
+// come from the interface each component implements, so new methods show
+// up without changes here; new components must be added.
+var dashboardComponents = []struct {
+	component  string
+	operations func() []string
+}{
+	{"API", apiOperations},
+	{"preprocessor", preprocessStageNames},
+	{"DB", methodNames((*repository)(nil))},
+	{"search", methodNames((*searcher)(nil))},
+	{"images", methodNames((*imageStore)(nil))},
+	{"resizer", methodNames((*resizer)(nil))},
+	{"postprocessor", postprocessStageNames},
+}
+
+// apiOperations are the route templates of the API, as named by
+// newRouteNamer.
+func apiOperations() []string {
+	var (
+		a          = newAPI(nil, nil, nil, nil, nil, nil, nil, 0, nil)
+		seen       = map[string]bool{}
+		operations []string
+	)
+	a.Router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if name := routeName(route); !seen[name] {
+			seen[name] = true
+			operations = append(operations, name)
+		}
+		return nil
+	})
+	if !seen["other"] {
+		operations = append(operations, "other")
+	}
+	return operations
+}
+
+func methodNames(iface interface{}) func() []string {
+	return func() []string {
+		t := reflect.TypeOf(iface).Elem()
+		names := make([]string, t.NumMethod())
+		for i := range names {
+			names[i] = t.Method(i).Name
+		}
+		return names
+	}
+}
+
+// The subset of the Grafana dashboard model we use.
+type (
+	grafanaDashboard struct {
+		UID           string              `json:"uid"`
+		Title         string              `json:"title"`
+		Tags          []string            `json:"tags"`
+		Timezone      string              `json:"timezone"`
+		SchemaVersion int                 `json:"schemaVersion"`
+		Refresh       string              `json:"refresh"`
+		Time          grafanaTime         `json:"time"`
+		Templating    grafanaTemplating   `json:"templating"`
+		Panels        []grafanaPanel      `json:"panels"`
+		Annotations   grafanaAnnotations  `json:"annotations"`
+		Links         []map[string]string `json:"links"`
+	}
+	grafanaTime struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	grafanaTemplating struct {
+		List []grafanaVariable `json:"list"`
+	}
+	grafanaAnnotations struct {
+		List []interface{} `json:"list"`
+	}
+	grafanaVariable struct {
+		Name  string `json:"name"`
+		Label string `json:"label"`
+		Type  string `json:"type"`
+		Query string `json:"query"`
+	}
+	grafanaPanel struct {
+		ID          int                 `json:"id"`
+		Type        string              `json:"type"`
+		Title       string              `json:"title"`
+		GridPos     grafanaGridPos      `json:"gridPos"`
+		Datasource  *grafanaDatasource  `json:"datasource,omitempty"`
+		Targets     []grafanaTarget     `json:"targets,omitempty"`
+		FieldConfig *grafanaFieldConfig `json:"fieldConfig,omitempty"`
+		Collapsed   *bool               `json:"collapsed,omitempty"`
+	}
+	grafanaGridPos struct {
+		H int `json:"h"`
+		W int `json:"w"`
+		X int `json:"x"`
+		Y int `json:"y"`
+	}
+	grafanaDatasource struct {
+		Type string `json:"type"`
+		UID  string `json:"uid"`
+	}
+	grafanaTarget struct {
+		RefID        string `json:"refId"`
+		Expr         string `json:"expr"`
+		LegendFormat string `json:"legendFormat"`
+		Exemplar     bool   `json:"exemplar"`
+	}
+	grafanaFieldConfig struct {
+		Defaults  map[string]interface{} `json:"defaults"`
+		Overrides []interface{}          `json:"overrides"`
+	}
+)
+
+const durationMetric = "breakfast_solutions_service_request_duration_seconds"
+
+// dashboardCmd writes a Grafana dashboard for the service to stdout. It has
+// request rate and latency panels for every component and operation in the
+// request duration histogram, and panels for the service's own health.
+func dashboardCmd(args []string) error {
+	var (
+		fs    = flag.NewFlagSet("dashboard", flag.ExitOnError)
+		uid   = fs.String("uid", "breakfast-solutions", "dashboard UID")
+		title = fs.String("title", "Breakfast Solutions", "dashboard title")
+	)
+	fs.Parse(args)
+
+	d := grafanaDashboard{
+		UID:           *uid,
+		Title:         *title,
+		Tags:          []string{"breakfast-solutions", "generated"},
+		Timezone:      "browser",
+		SchemaVersion: 36,
+		Refresh:       "30s",
+		Time:          grafanaTime{From: "now-1h", To: "now"},
+		Templating: grafanaTemplating{List: []grafanaVariable{
+			{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+		}},
+		Annotations: grafanaAnnotations{List: []interface{}{}},
+		Links:       []map[string]string{},
+	}
+
+	var b dashboardBuilder
+	b.row("Health")
+	b.panel("Requests by status code class", "reqps",
+		target("sum by (code) (rate(breakfast_solutions_service_requests_total[$__rate_interval]))", "{{code}}"),
+	)
+	b.panel("Requests in flight", "short",
+		target("sum(breakfast_solutions_service_requests_in_flight)", "in flight"),
+	)
+	b.panel("Circuit breaker state", "short",
+		target("max(breakfast_solutions_service_circuit_breaker_state)", "0 closed, 1 half-open, 2 open"),
+	)
+	b.panel("Logging and tracing errors", "short",
+		target("sum by (pipeline) (rate(breakfast_solutions_service_telemetry_errors_total[$__rate_interval]))", "{{pipeline}}"),
+	)
+	b.panel("Response size p99", "bytes",
+		target("histogram_quantile(0.99, sum by (le, operation) (rate(breakfast_solutions_service_response_size_bytes_bucket[$__rate_interval])))", "{{operation}}"),
+	)
+	b.panel("Not modified", "reqps",
+		target("sum by (operation) (rate(breakfast_solutions_service_not_modified_total[$__rate_interval]))", "{{operation}}"),
+	)
+	b.row("Breakfasts")
+	b.panel("Top breakfasts served", "reqps",
+		target("topk(10, sum by (id) (rate(breakfast_solutions_breakfasts_served_by_id_total[$__rate_interval])))", "{{id}}"),
+	)
+	b.panel("Breakfasts served by region and route", "reqps",
+		target("sum by (region, via) (rate(breakfast_solutions_breakfasts_served_total[$__rate_interval]))", "{{region}} {{via}}"),
+	)
+	for _, c := range dashboardComponents {
+		b.row(c.component)
+		for _, operation := range c.operations() {
+			selector := fmt.Sprintf(`component=%q, operation=%q`, c.component, operation)
+			b.panel(operation+" rate", "reqps",
+				target(fmt.Sprintf("sum by (success) (rate(%s_count{%s}[$__rate_interval]))", durationMetric, selector), "success={{success}}"),
+			)
+			b.panel(operation+" latency", "s",
+				target(fmt.Sprintf("histogram_quantile(0.50, sum by (le) (rate(%s_bucket{%s}[$__rate_interval])))", durationMetric, selector), "p50"),
+				target(fmt.Sprintf("histogram_quantile(0.99, sum by (le) (rate(%s_bucket{%s}[$__rate_interval])))", durationMetric, selector), "p99"),
+			)
+		}
+	}
+	d.Panels = b.panels
+
+	encodeJSON(os.Stdout, d)
+	return nil
+}
+
+// dashboardBuilder lays panels out two to a row, in rows of their own.
+type dashboardBuilder struct {
+	panels []grafanaPanel
+	x, y   int
+}
+
+func (b *dashboardBuilder) row(title string) {
+	if b.x > 0 {
+		b.x, b.y = 0, b.y+8
+	}
+	collapsed := false
+	b.panels = append(b.panels, grafanaPanel{
+		ID:        len(b.panels) + 1,
+		Type:      "row",
+		Title:     title,
+		GridPos:   grafanaGridPos{H: 1, W: 24, X: 0, Y: b.y},
+		Collapsed: &collapsed,
+	})
+	b.y++
+}
+
+func (b *dashboardBuilder) panel(title, unit string, targets ...grafanaTarget) {
+	for i := range targets {
+		targets[i].RefID = string(rune('A' + i))
+	}
+	b.panels = append(b.panels, grafanaPanel{
+		ID:         len(b.panels) + 1,
+		Type:       "timeseries",
+		Title:      title,
+		GridPos:    grafanaGridPos{H: 8, W: 12, X: b.x, Y: b.y},
+		Datasource: &grafanaDatasource{Type: "prometheus", UID: "${datasource}"},
+		Targets:    targets,
+		FieldConfig: &grafanaFieldConfig{
+			Defaults:  map[string]interface{}{"unit": unit},
+			Overrides: []interface{}{},
+		},
+	})
+	if b.x == 0 {
+		b.x = 12
+	} else {
+		b.x, b.y = 0, b.y+8
+	}
+}
+
+func target(expr, legend string) grafanaTarget {
+	return grafanaTarget{Expr: expr, LegendFormat: legend, Exemplar: true}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// breakfastFilter narrows down the set of breakfasts by tag.
+type breakfastFilter struct {
+	tags    []string // must have all of these
+	exclude []string // must have none of these
+}
+
+// getFilter parses the repeatable, comma-separated tag and exclude query
+// parameters, e.g. ?tag=sweet,vegetarian&exclude=vegan.
+func getFilter(r *http.Request) breakfastFilter {
+	return breakfastFilter{
+		tags:    splitTags(r.URL.Query()["tag"]),
+		exclude: splitTags(r.URL.Query()["exclude"]),
+	}
+}
+
+func splitTags(values []string) (tags []string) {
+	for _, v := range values {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+func (f breakfastFilter) empty() bool {
+	return len(f.tags) == 0 && len(f.exclude) == 0
+}
+
+func (f breakfastFilter) match(b breakfast) bool {
+	for _, tag := range f.tags {
+		if !b.hasTag(tag) {
+			return false
+		}
+	}
+	for _, tag := range f.exclude {
+		if b.hasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f breakfastFilter) apply(a []breakfast) []breakfast {
+	if f.empty() {
+		return a
+	}
+	var matched []breakfast
+	for _, b := range a {
+		if f.match(b) {
+			matched = append(matched, b)
+		}
+	}
+	return matched
+}
+
+// String renders the filter in its query parameter form, for logs and traces.
+func (f breakfastFilter) String() string {
+	var parts []string
+	if len(f.tags) > 0 {
+		parts = append(parts, "tag="+strings.Join(f.tags, ","))
+	}
+	if len(f.exclude) > 0 {
+		parts = append(parts, "exclude="+strings.Join(f.exclude, ","))
+	}
+	return strings.Join(parts, "&")
+}
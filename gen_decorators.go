@@ -0,0 +1,426 @@
+//go:build ignore
+// +build ignore
+
+// gen_decorators writes logging, metrics and tracing middlewares for every
+// method of an interface, so they can't drift from it. Run it with go
+// generate; see the directive on the interface.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// field is a key and the expression for its value, with %s standing for
+// the parameter or result. Tags are set on the span rather than logged.
+type field struct {
+	key, expr string
+	tag       bool
+}
+
+// fieldsByType say how to render parameters and results of each type.
+// Parameters of other types are rendered as themselves, keyed by their
+// name. Results of other types are an error: add them here.
+var fieldsByType = map[string][]field{
+	"breakfastFilter": {{key: "filter", expr: "%s.String()"}},
+	"randomQuery": {
+		{key: "seed", expr: "%s.seed"},
+		{key: "filter", expr: "%s.filter.String()"},
+		{key: "mode", expr: "string(%s.mode)"},
+	},
+	"time.Time":    {{key: "day", expr: `%s.Format("2006-01-02 MST")`}},
+	"breakfast":    {{key: "returned_breakfast_id", expr: "%s.ID"}},
+	"[]breakfast":  {{key: "returned_count", expr: "len(%s)"}},
+	"choiceReason": {{key: "choice_reason", expr: "string(%s)", tag: true}},
+}
+
+// fieldsByMethod override fieldsByType for the results of particular
+// methods, by method and then result type, where what's worth recording
+// depends on the method.
+var fieldsByMethod = map[string]map[string][]field{
+	"rateBreakfast": {"breakfast": {{key: "average_rating", expr: "%s.AverageRating"}}},
+}
+
+func main() {
+	var (
+		input     = flag.String("input", os.Getenv("GOFILE"), "file declaring the interface")
+		typ       = flag.String("type", "", "interface to decorate")
+		name      = flag.String("name", "", "middleware name, e.g. Repo for loggingRepoMiddleware")
+		component = flag.String("component", "", "component label for the duration histogram")
+		logPrefix = flag.String("log.prefix", "", "prefix for log keys, e.g. db_")
+		span      = flag.String("span", "", "span operation name")
+		output    = flag.String("output", "", "file to write")
+	)
+	flag.Parse()
+	if *typ == "" || *name == "" || *component == "" || *span == "" || *output == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, *input, nil, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	iface, err := findInterface(file, *typ)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	d := decorators{
+		Command:   "gen_decorators " + strings.Join(withoutOutput(os.Args[1:]), " "),
+		Package:   file.Name.Name,
+		Type:      *typ,
+		Name:      *name,
+		Component: *component,
+		LogPrefix: *logPrefix,
+		Span:      *span,
+		Imports: map[string]string{
+			"context":                               "",
+			"fmt":                                   "",
+			"time":                                  "",
+			"github.com/opentracing/opentracing-go": "opentracing",
+		},
+	}
+	used := map[string]bool{}
+	for _, m := range iface.Methods.List {
+		fn, ok := m.Type.(*ast.FuncType)
+		if !ok || len(m.Names) != 1 {
+			log.Fatalf("%s: embedded interfaces aren't supported", fset.Position(m.Pos()))
+		}
+		method, err := newMethod(m.Names[0].Name, fn, used)
+		if err != nil {
+			log.Fatalf("%s: %s: %v", fset.Position(m.Pos()), m.Names[0].Name, err)
+		}
+		d.Methods = append(d.Methods, method)
+	}
+	for _, spec := range file.Imports {
+		var (
+			path, _ = strconv.Unquote(spec.Path.Value)
+			pkg     = path[strings.LastIndex(path, "/")+1:]
+			alias   string
+		)
+		if spec.Name != nil {
+			pkg, alias = spec.Name.Name, spec.Name.Name
+		}
+		if _, ok := d.Imports[path]; used[pkg] && !ok {
+			d.Imports[path] = alias
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := decoratorsTemplate.Execute(&buf, d); err != nil {
+		log.Fatal(err)
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalf("formatting generated code: %v\n%s", err, buf.Bytes())
+	}
+	if err := ioutil.WriteFile(*output, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// withoutOutput drops -output and its value from args, so the header of
+// the generated file doesn't depend on where it was written.
+func withoutOutput(args []string) []string {
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		switch name := strings.TrimLeft(args[i], "-"); {
+		case !strings.HasPrefix(args[i], "-"):
+			kept = append(kept, args[i])
+		case name == "output":
+			i++ // skip the value too
+		case strings.HasPrefix(name, "output="):
+		default:
+			kept = append(kept, args[i])
+		}
+	}
+	return kept
+}
+
+func findInterface(file *ast.File, name string) (*ast.InterfaceType, error) {
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if ts.Name.Name != name {
+				continue
+			}
+			iface, ok := ts.Type.(*ast.InterfaceType)
+			if !ok {
+				return nil, fmt.Errorf("%s isn't an interface", name)
+			}
+			return iface, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s not found", name)
+}
+
+type decorators struct {
+	Command   string
+	Package   string
+	Type      string
+	Name      string
+	Component string
+	LogPrefix string
+	Span      string
+	Imports   map[string]string // path to name, if any
+	Methods   []method
+}
+
+// ImportGroups returns the import specs, standard library first.
+func (d decorators) ImportGroups() [][]string {
+	var std, other []string
+	for path, name := range d.Imports {
+		spec := strconv.Quote(path)
+		if name != "" {
+			spec = name + " " + spec
+		}
+		if strings.Contains(strings.Split(path, "/")[0], ".") {
+			other = append(other, spec)
+		} else {
+			std = append(std, spec)
+		}
+	}
+	sort.Slice(std, func(i, j int) bool { return unaliased(std[i]) < unaliased(std[j]) })
+	sort.Slice(other, func(i, j int) bool { return unaliased(other[i]) < unaliased(other[j]) })
+	return [][]string{std, other}
+}
+
+func unaliased(spec string) string {
+	return spec[strings.Index(spec, `"`):]
+}
+
+type method struct {
+	Name    string
+	Params  string // with types, for the signature
+	Results string // named, for the signature
+	Args    string // for the call
+	Ctx     string
+	Err     string
+	In, Out []field // rendered, in order
+}
+
+// newMethod requires methods to take a context first and return an error
+// last, and records the packages their types refer to in used.
+func newMethod(name string, fn *ast.FuncType, used map[string]bool) (method, error) {
+	m := method{Name: name}
+
+	var params, args []string
+	for i, p := range flatten(fn.Params) {
+		if p.name == "" || p.name == "_" {
+			p.name = fmt.Sprintf("p%d", i)
+		}
+		if i == 0 {
+			if p.typ != "context.Context" {
+				return m, fmt.Errorf("first parameter must be a context.Context")
+			}
+			m.Ctx = p.name
+		}
+		params = append(params, p.name+" "+p.typ)
+		if strings.HasPrefix(p.typ, "...") {
+			args = append(args, p.name+"...")
+		} else {
+			args = append(args, p.name)
+		}
+		p.addPackages(used)
+		if i == 0 {
+			continue
+		}
+		fields, ok := fieldsByType[p.typ]
+		if !ok {
+			fields = []field{{key: snake(p.name), expr: "%s"}}
+		}
+		m.In = append(m.In, render(fields, p.name)...)
+	}
+
+	results := flatten(fn.Results)
+	if len(results) == 0 || results[len(results)-1].typ != "error" {
+		return m, fmt.Errorf("last result must be an error")
+	}
+	var named []string
+	for i, r := range results {
+		r.name = fmt.Sprintf("r%d", i)
+		if i == len(results)-1 {
+			r.name = "err"
+			m.Err = r.name
+		}
+		named = append(named, r.name+" "+r.typ)
+		r.addPackages(used)
+		if i == len(results)-1 {
+			continue
+		}
+		fields, ok := fieldsByMethod[name][r.typ]
+		if !ok {
+			fields, ok = fieldsByType[r.typ]
+		}
+		if !ok {
+			return m, fmt.Errorf("don't know how to render a %s result; add it to fieldsByType", r.typ)
+		}
+		m.Out = append(m.Out, render(fields, r.name)...)
+	}
+
+	m.Params = strings.Join(params, ", ")
+	m.Results = strings.Join(named, ", ")
+	m.Args = strings.Join(args, ", ")
+	return m, nil
+}
+
+type value struct {
+	name string
+	typ  string
+	expr ast.Expr
+}
+
+func flatten(fl *ast.FieldList) []value {
+	if fl == nil {
+		return nil
+	}
+	var values []value
+	for _, f := range fl.List {
+		typ := types.ExprString(f.Type)
+		if len(f.Names) == 0 {
+			values = append(values, value{typ: typ, expr: f.Type})
+		}
+		for _, n := range f.Names {
+			values = append(values, value{name: n.Name, typ: typ, expr: f.Type})
+		}
+	}
+	return values
+}
+
+func (v value) addPackages(used map[string]bool) {
+	ast.Inspect(v.expr, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok {
+				used[id.Name] = true
+			}
+		}
+		return true
+	})
+}
+
+func render(fields []field, name string) []field {
+	rendered := make([]field, len(fields))
+	for i, f := range fields {
+		rendered[i] = field{key: f.key, expr: fmt.Sprintf(f.expr, name), tag: f.tag}
+	}
+	return rendered
+}
+
+// Key, Expr and Tag are for the template.
+func (f field) Key() string  { return f.key }
+func (f field) Expr() string { return f.expr }
+func (f field) Tag() bool    { return f.tag }
+
+// snake converts e.g. breakfastID to breakfast_id.
+func snake(s string) string {
+	var (
+		b    strings.Builder
+		prev rune
+	)
+	for _, r := range s {
+		if unicode.IsUpper(r) && unicode.IsLower(prev) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+		prev = r
+	}
+	return b.String()
+}
+
+var decoratorsTemplate = template.Must(template.New("decorators").Parse(`// Code generated by {{ .Command }}; DO NOT EDIT.
+
+package {{ .Package }}
+
+import (
+{{- range $i, $group := .ImportGroups }}{{ if $i }}
+{{ end }}
+{{- range $group }}
+	{{ . }}
+{{- end }}
+{{- end }}
+)
+{{ $d := . }}
+type logging{{ .Name }}Middleware struct {
+	next {{ .Type }}
+}
+{{ range .Methods }}
+func (m logging{{ $d.Name }}Middleware) {{ .Name }}({{ .Params }}) ({{ .Results }}) {
+	defer func(begin time.Time) {
+		getContextLogger({{ .Ctx }}).add(
+			"{{ $d.LogPrefix }}method", "{{ .Name }}",
+			{{- range .In }}
+			"{{ $d.LogPrefix }}{{ .Key }}", {{ .Expr }},
+			{{- end }}
+			"{{ $d.LogPrefix }}took", time.Since(begin).String(),
+			"{{ $d.LogPrefix }}sec", time.Since(begin).Seconds(),
+			"{{ $d.LogPrefix }}success", {{ .Err }} == nil,
+			{{- range .Out }}
+			"{{ $d.LogPrefix }}{{ .Key }}", {{ .Expr }},
+			{{- end }}
+			"{{ $d.LogPrefix }}err", {{ .Err }},
+		)
+	}(time.Now())
+	return m.next.{{ .Name }}({{ .Args }})
+}
+{{ end }}
+type metrics{{ .Name }}Middleware struct {
+	next {{ .Type }}
+}
+{{ range .Methods }}
+func (m metrics{{ $d.Name }}Middleware) {{ .Name }}({{ .Params }}) ({{ .Results }}) {
+	defer func(begin time.Time) {
+		observe({{ .Ctx }}, getContextHistogram({{ .Ctx }}).WithLabelValues(
+			"{{ $d.Component }}", "{{ .Name }}", fmt.Sprint({{ .Err }} == nil),
+		), time.Since(begin).Seconds())
+	}(time.Now())
+	return m.next.{{ .Name }}({{ .Args }})
+}
+{{ end }}
+type tracing{{ .Name }}Middleware struct {
+	next {{ .Type }}
+}
+{{ range .Methods }}
+func (m tracing{{ $d.Name }}Middleware) {{ .Name }}({{ .Params }}) ({{ .Results }}) {
+	span, {{ .Ctx }} := opentracing.StartSpanFromContext({{ .Ctx }}, "{{ $d.Span }}")
+	defer span.Finish()
+	defer func(begin time.Time) {
+		{{- range .Out }}{{ if .Tag }}
+		span.SetTag("{{ .Key }}", {{ .Expr }})
+		{{- end }}{{ end }}
+		span.LogKV(
+			"method", "{{ .Name }}",
+			{{- range .In }}
+			"{{ .Key }}", {{ .Expr }},
+			{{- end }}
+			"took", time.Since(begin).String(),
+			"sec", time.Since(begin).Seconds(),
+			"success", {{ .Err }} == nil,
+			{{- range .Out }}{{ if not .Tag }}
+			"{{ .Key }}", {{ .Expr }},
+			{{- end }}{{ end }}
+			"err", {{ .Err }},
+		)
+	}(time.Now())
+	return m.next.{{ .Name }}({{ .Args }})
+}
+{{ end }}`))
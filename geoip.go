@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+const unknownRegion = "??"
+
+// isRegion reports whether s has the shape of a region, i.e. a lower-case
+// ISO country code. Regions are used as metric labels, so anything else,
+// which could come from a client, must not be.
+func isRegion(s string) bool {
+	return len(s) == 2 && 'a' <= s[0] && s[0] <= 'z' && 'a' <= s[1] && s[1] <= 'z'
+}
+
+// geoIP resolves IP addresses to regions, i.e. lower-case ISO country codes,
+// with a MaxMind-format database such as GeoLite2 Country or City.
+type geoIP struct {
+	db *maxminddb.Reader
+}
+
+func openGeoIP(filename string) (*geoIP, error) {
+	db, err := maxminddb.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &geoIP{db: db}, nil
+}
+
+func (g *geoIP) region(ip net.IP) string {
+	if g == nil || ip == nil {
+		return unknownRegion
+	}
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := g.db.Lookup(ip, &record); err != nil {
+		return unknownRegion
+	}
+	if region := strings.ToLower(record.Country.ISOCode); isRegion(region) {
+		return region
+	}
+	return unknownRegion
+}
+
+func (g *geoIP) Close() error {
+	return g.db.Close()
+}
+
+// trustedProxies are the networks of our own reverse proxies, whose
+// X-Forwarded-For headers we believe.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or bare IPs,
+// e.g. 10.0.0.0/8,192.168.1.1.
+func parseTrustedProxies(s string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			switch {
+			case ip == nil:
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			case ip.To4() != nil:
+				cidr += "/32"
+			default:
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (p trustedProxies) contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// originIP is the address of the client that sent r. Clients can put
+// anything in X-Forwarded-For, so it's only read when the request came from
+// a trusted proxy, and then from the right, where each proxy appends the
+// address it received the request from. The first address that isn't a
+// trusted proxy is the client.
+func (p trustedProxies) originIP(r *http.Request) string {
+	origin, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		origin = r.RemoteAddr
+	}
+	if !p.contains(origin) {
+		return origin
+	}
+	xff := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(xff) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(xff[i])
+		if addr == "" {
+			continue
+		}
+		origin = addr
+		if !p.contains(addr) {
+			break
+		}
+	}
+	return origin
+}
+
+// regionHintAPIMiddleware takes region hints from ?region=, for testing
+// from places we don't have addresses for. Only for debug mode, as clients
+// could otherwise claim any region. Hints that aren't shaped like a region
+// are ignored.
+func regionHintAPIMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if region := strings.ToLower(r.URL.Query().Get("region")); isRegion(region) {
+			r = r.WithContext(withRegionHint(r.Context(), region))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
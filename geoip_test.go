@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTrustedProxiesOriginIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{"direct", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"direct, spoofed header", "203.0.113.7:1234", []string{"1.2.3.4"}, "203.0.113.7"},
+		{"one proxy", "10.0.0.1:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"one proxy, spoofed header", "10.0.0.1:1234", []string{"1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{"two proxies", "10.0.0.1:1234", []string{"1.2.3.4, 203.0.113.7, 192.168.1.1"}, "203.0.113.7"},
+		{"two headers", "10.0.0.1:1234", []string{"1.2.3.4", "203.0.113.7"}, "203.0.113.7"},
+		{"only proxies", "10.0.0.1:1234", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"proxy without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, xff := range tc.xff {
+				r.Header.Add("X-Forwarded-For", xff)
+			}
+			if have := proxies.originIP(r); have != tc.want {
+				t.Errorf("have %s, want %s", have, tc.want)
+			}
+		})
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Errorf("want an error for an invalid CIDR")
+	}
+}
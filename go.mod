@@ -0,0 +1,32 @@
+module github.com/peterbourgon/breakfast-solutions
+
+go 1.23.0
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/go-kit/kit v0.10.0
+	github.com/gorilla/mux v1.8.1
+	github.com/oklog/run v1.2.0
+	github.com/opentracing/opentracing-go v1.2.0
+	github.com/oschwald/maxminddb-golang v1.3.1
+	github.com/prometheus/client_golang v1.12.2
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.32.1
+	github.com/uber/jaeger-client-go v2.30.0+incompatible
+	github.com/uber/jaeger-lib v2.4.1+incompatible
+)
+
+require (
+	github.com/HdrHistogram/hdrhistogram-go v1.3.0 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/go-logfmt/logfmt v0.5.1 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/google/go-cmp v0.7.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	go.uber.org/atomic v1.12.0 // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	google.golang.org/protobuf v1.36.9 // indirect
+)
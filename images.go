@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// imageStore holds breakfast images by key. Uploaded images are stored under
+// their content address; see imageKey.
+type imageStore interface {
+	putImage(ctx context.Context, key, contentType string, data []byte) error
+	getImage(ctx context.Context, key string) (rc io.ReadCloser, contentType string, modTime time.Time, err error)
+}
+
+var errImageNotFound = errors.New("image not found")
+
+// imageTypes are the sniffed content types we accept for upload, and the
+// file extensions they're stored with.
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// imageKey is the content address for an image: the hex SHA-256 of its
+// data, plus an extension so it can be served with the right type.
+func imageKey(data []byte, ext string) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) + ext
+}
+
+// validImageKey rejects keys that could escape the store, e.g. via "..".
+func validImageKey(key string) bool {
+	return key != "" && key != "." && key != ".." && !strings.ContainsAny(key, `/\`)
+}
+
+// localImageStore keeps images as flat files in a directory. Hand-placed
+// files, like the ones referenced by the stock breakfasts.json, are served
+// just the same as uploaded ones.
+type localImageStore struct {
+	dir string
+}
+
+func newLocalImageStore(dir string) (*localImageStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localImageStore{dir: dir}, nil
+}
+
+func (s *localImageStore) putImage(_ context.Context, key, _ string, data []byte) error {
+	if !validImageKey(key) {
+		return errImageNotFound
+	}
+	filename := filepath.Join(s.dir, key)
+	if _, err := os.Stat(filename); err == nil {
+		return nil // content-addressed, so it's already there
+	}
+	return writeFileAtomic(filename, data)
+}
+
+func (s *localImageStore) getImage(_ context.Context, key string) (io.ReadCloser, string, time.Time, error) {
+	if !validImageKey(key) {
+		return nil, "", time.Time{}, errImageNotFound
+	}
+	f, err := os.Open(filepath.Join(s.dir, key))
+	if os.IsNotExist(err) {
+		return nil, "", time.Time{}, errImageNotFound
+	}
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, "", time.Time{}, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(key))
+	if contentType == "" {
+		contentType = sniffContentType(f)
+	}
+	return f, contentType, fi.ModTime(), nil
+}
+
+func sniffContentType(f *os.File) string {
+	buf, _ := ioutil.ReadAll(io.LimitReader(f, 512))
+	f.Seek(0, io.SeekStart)
+	return http.DetectContentType(buf)
+}
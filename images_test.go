@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalImageStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "breakfast-images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newLocalImageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ctx  = context.Background()
+		data = []byte("GIF89a not really a gif")
+		key  = imageKey(data, ".gif")
+	)
+	if err := s.putImage(ctx, key, "image/gif", data); err != nil {
+		t.Fatalf("putImage: %v", err)
+	}
+	if err := s.putImage(ctx, key, "image/gif", data); err != nil {
+		t.Fatalf("putImage again: %v", err)
+	}
+
+	rc, contentType, modTime, err := s.getImage(ctx, key)
+	if err != nil {
+		t.Fatalf("getImage: %v", err)
+	}
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(got, data) {
+		t.Errorf("data: have %q, want %q", got, data)
+	}
+	if want := "image/gif"; contentType != want {
+		t.Errorf("content type: have %q, want %q", contentType, want)
+	}
+	if modTime.IsZero() {
+		t.Errorf("mod time: want the file's")
+	}
+
+	// Hand-placed files without a known extension are sniffed.
+	if err := ioutil.WriteFile(filepath.Join(dir, "toast"), []byte("\x89PNG\r\n\x1a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rc, contentType, _, err = s.getImage(ctx, "toast")
+	if err != nil {
+		t.Fatalf("getImage: %v", err)
+	}
+	rc.Close()
+	if want := "image/png"; contentType != want {
+		t.Errorf("sniffed content type: have %q, want %q", contentType, want)
+	}
+
+	for _, key := range []string{"missing.gif", "..", "../" + key, `a\b`, ""} {
+		if _, _, _, err := s.getImage(ctx, key); err != errImageNotFound {
+			t.Errorf("getImage(%q): have %v, want %v", key, err, errImageNotFound)
+		}
+	}
+	if err := s.putImage(ctx, "../escape.gif", "image/gif", data); err != errImageNotFound {
+		t.Errorf("putImage outside the dir: have %v, want %v", err, errImageNotFound)
+	}
+}
@@ -3,13 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/go-kit/kit/log"
 )
 
-func loggingAPIMiddleware(next http.Handler, logger log.Logger) http.Handler {
+func loggingAPIMiddleware(next http.Handler, logger log.Logger, route routeNamer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var (
 			iw  = &interceptingWriter{0, http.StatusOK, w}
@@ -23,6 +25,7 @@ func loggingAPIMiddleware(next http.Handler, logger log.Logger) http.Handler {
 			"http_req_remoteaddr", r.RemoteAddr,
 			"http_req_method", r.Method,
 			"http_req_url", r.URL.String(),
+			"http_req_route", route(r),
 			"http_req_contentlength", r.ContentLength,
 		)
 		begin := time.Now()
@@ -38,62 +41,106 @@ func loggingAPIMiddleware(next http.Handler, logger log.Logger) http.Handler {
 	})
 }
 
-func loggingPreprocessMiddleware(next preprocessor) preprocessor {
-	return func(ctx context.Context, region string) context.Context {
+func loggingPreprocessMiddleware(next preprocessor, stage string, report func(context.Context) []interface{}) preprocessor {
+	prefix := "preprocess_" + stage + "_"
+	return func(ctx context.Context, originIP string) (result context.Context) {
 		defer func(begin time.Time) {
-			getContextLogger(ctx).add(
-				"preprocess_region", region,
-				"preprocess_took", time.Since(begin).String(),
-				"preprocess_sec", time.Since(begin).Seconds(),
-			)
+			keyvals := report(result)
+			for i := 0; i < len(keyvals); i += 2 {
+				keyvals[i] = prefix + fmt.Sprint(keyvals[i])
+			}
+			getContextLogger(ctx).add(append(keyvals,
+				prefix+"took", time.Since(begin).String(),
+				prefix+"sec", time.Since(begin).Seconds(),
+			)...)
 		}(time.Now())
-		return next(ctx, region)
+		return next(ctx, originIP)
 	}
 }
 
-type loggingRepoMiddleware struct {
-	next repository
+type loggingSearchMiddleware struct {
+	next searcher
 }
 
-func (m loggingRepoMiddleware) getBreakfast(ctx context.Context, username string, breakfastID uint64) (b breakfast, err error) {
+func (m loggingSearchMiddleware) search(ctx context.Context, query string) (results []searchResult, err error) {
 	defer func(begin time.Time) {
 		getContextLogger(ctx).add(
-			"db_method", "getBreakfast",
-			"db_username", username,
-			"db_breakfast_id", breakfastID,
-			"db_took", time.Since(begin).String(),
-			"db_sec", time.Since(begin).Seconds(),
-			"db_success", err == nil,
-			"db_returned_breakfast_id", b.ID,
-			"db_err", err,
+			"search_query", query,
+			"search_took", time.Since(begin).String(),
+			"search_sec", time.Since(begin).Seconds(),
+			"search_success", err == nil,
+			"search_returned_count", len(results),
+			"search_err", err,
 		)
 	}(time.Now())
-	return m.next.getBreakfast(ctx, username, breakfastID)
+	return m.next.search(ctx, query)
+}
+
+type loggingImageMiddleware struct {
+	next imageStore
 }
 
-func (m loggingRepoMiddleware) getRandomBreakfast(ctx context.Context, username string) (b breakfast, err error) {
+func (m loggingImageMiddleware) putImage(ctx context.Context, key, contentType string, data []byte) (err error) {
 	defer func(begin time.Time) {
 		getContextLogger(ctx).add(
-			"db_method", "getRandomBreakfast",
-			"db_username", username,
-			"db_took", time.Since(begin).String(),
-			"db_sec", time.Since(begin).Seconds(),
-			"db_success", err == nil,
-			"db_returned_breakfast_id", b.ID,
-			"db_err", err,
+			"images_method", "putImage",
+			"images_key", key,
+			"images_content_type", contentType,
+			"images_size", len(data),
+			"images_took", time.Since(begin).String(),
+			"images_sec", time.Since(begin).Seconds(),
+			"images_success", err == nil,
+			"images_err", err,
 		)
 	}(time.Now())
-	return m.next.getRandomBreakfast(ctx, username)
+	return m.next.putImage(ctx, key, contentType, data)
 }
 
-func loggingPostprocessMiddleware(next postprocessor) postprocessor {
+func (m loggingImageMiddleware) getImage(ctx context.Context, key string) (rc io.ReadCloser, contentType string, modTime time.Time, err error) {
+	defer func(begin time.Time) {
+		getContextLogger(ctx).add(
+			"images_method", "getImage",
+			"images_key", key,
+			"images_content_type", contentType,
+			"images_took", time.Since(begin).String(),
+			"images_sec", time.Since(begin).Seconds(),
+			"images_success", err == nil,
+			"images_err", err,
+		)
+	}(time.Now())
+	return m.next.getImage(ctx, key)
+}
+
+type loggingResizeMiddleware struct {
+	next resizer
+}
+
+func (m loggingResizeMiddleware) resize(ctx context.Context, key string, width, height int) (data []byte, contentType string, cached bool, err error) {
+	defer func(begin time.Time) {
+		getContextLogger(ctx).add(
+			"resize_key", key,
+			"resize_width", width,
+			"resize_height", height,
+			"resize_cached", cached,
+			"resize_size", len(data),
+			"resize_took", time.Since(begin).String(),
+			"resize_sec", time.Since(begin).Seconds(),
+			"resize_success", err == nil,
+			"resize_err", err,
+		)
+	}(time.Now())
+	return m.next.resize(ctx, key, width, height)
+}
+
+func loggingPostprocessMiddleware(next postprocessor, stage string) postprocessor {
+	prefix := "postprocess_" + stage + "_"
 	return func(ctx context.Context, username string, success bool) context.Context {
 		defer func(begin time.Time) {
 			getContextLogger(ctx).add(
-				"postprocess_username", username,
-				"postprocess_success", fmt.Sprint(success),
-				"postprocess_took", time.Since(begin).String(),
-				"postprocess_sec", time.Since(begin).Seconds(),
+				prefix+"username", username,
+				prefix+"success", fmt.Sprint(success),
+				prefix+"took", time.Since(begin).String(),
+				prefix+"sec", time.Since(begin).Seconds(),
 			)
 		}(time.Now())
 		return next(ctx, username, success)
@@ -104,6 +151,13 @@ func loggingPostprocessMiddleware(next postprocessor) postprocessor {
 //
 //
 
+func bucketString(ctx context.Context) string {
+	if bucket, ok := getContextBucket(ctx); ok {
+		return strconv.Itoa(bucket)
+	}
+	return ""
+}
+
 type contextLoggerKey struct{}
 
 type contextLogger struct{ Keyvals []interface{} }
@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -24,16 +26,59 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		var cmd func([]string) error
+		switch os.Args[1] {
+		case "slo-rules":
+			cmd = sloRulesCmd
+		case "dashboard":
+			cmd = dashboardCmd
+		case "version":
+			cmd = versionCmd
+		case "validate":
+			cmd = validateCmd
+		}
+		if cmd != nil {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	var (
-		apiAddr    = flag.String("api", ":443", "API listen address")
-		promAddr   = flag.String("prometheus", ":8081", "Prometheus listen address")
-		jaegerAddr = flag.String("jaeger", "", "Jaeger host:port")
-		oklogAddr  = flag.String("oklog", "", "OK Log host:port")
-		cert       = flag.String("cert", "certs/server.crt", "TLS certificate")
-		key        = flag.String("key", "certs/server.key", "TLS key")
-		db         = flag.String("db", "breakfasts.json", "database file")
-		images     = flag.String("images", "images/", "image dir")
-		debug      = flag.Bool("debug", false, "print debug info")
+		apiAddr      = flag.String("api", ":443", "API listen address")
+		promAddr     = flag.String("prometheus", ":8081", "Prometheus listen address")
+		jaegerAddr   = flag.String("jaeger", "", "Jaeger host:port")
+		oklogAddr    = flag.String("oklog", "", "OK Log host:port")
+		cert         = flag.String("cert", "certs/server.crt", "TLS certificate")
+		key          = flag.String("key", "certs/server.key", "TLS key")
+		db           = flag.String("db", "breakfasts.json", "database file")
+		recommend    = flag.Duration("recommend.interval", 30*time.Second, "how often to recompute related breakfasts (0 disables)")
+		reload       = flag.Duration("db.reload", 5*time.Second, "how often to check the database file for changes (0 disables)")
+		images       = flag.String("images", "images/", "image dir, unless using S3")
+		imageCache   = flag.String("images.cache", filepath.Join(os.TempDir(), "breakfast-solutions-images"), "resized image cache dir")
+		maxImage     = flag.Int64("images.maxsize", 10<<20, "max uploaded image size in bytes")
+		s3Endpoint   = flag.String("s3.endpoint", "https://s3.amazonaws.com", "S3-compatible endpoint for images")
+		s3Bucket     = flag.String("s3.bucket", "", "S3 bucket for images (empty means use the image dir)")
+		s3Region     = flag.String("s3.region", "us-east-1", "S3 region")
+		sessions     = flag.String("sessions", "", "per-user history file (empty means in-memory)")
+		seed         = flag.Int64("seed", 0, "random seed for reproducible breakfasts (0 means time-based)")
+		failures     = flag.Int("breaker.failures", 5, "consecutive repository failures that open the circuit breaker (0 disables)")
+		timeout      = flag.Duration("breaker.timeout", 10*time.Second, "how long the circuit breaker stays open before probing")
+		probes       = flag.Int("breaker.probes", 1, "successful probes required to close the circuit breaker (at least 1)")
+		sloConfig    = flag.String("slo", "", "SLO config file, e.g. slos.json (empty means no SLIs)")
+		successes    = flag.String("api.success", "2xx,3xx,4xx", "status codes that count as success, e.g. 2xx,3xx,4xx;/admin=2xx,3xx for per-route overrides")
+		proxyNets    = flag.String("proxy.trusted", "", "our reverse proxies, as comma-separated CIDRs, whose X-Forwarded-For is believed (empty means use the peer address)")
+		geoipDB      = flag.String("geoip", "", "MaxMind-format GeoIP database, e.g. GeoLite2-Country.mmdb (empty means regions are unknown)")
+		preStages    = flag.String("pre", "geo", "preprocessor stages to run in order, from: "+strings.Join(preprocessStageNames(), ", "))
+		postStages   = flag.String("post", "basic", "postprocessor stages to run in order, from: "+strings.Join(postprocessStageNames(), ", "))
+		buckets      = flag.Int("bucket.count", 2, "number of A/B test buckets for the bucket stage")
+		auditSinkURL = flag.String("audit.sink", "", "where the audit stage publishes served events: a file, nats://host:port/subject or kafka+http://rest-proxy:port/topic")
+		auditQueue   = flag.Int("audit.queue", 1000, "max audit events waiting to be published, at least 1; more are dropped")
+		statsIDs     = flag.Int("stats.ids", 100, "max breakfast IDs with their own label in popularity metrics")
+		debug        = flag.Bool("debug", false, "print debug info, and take ?region= hints for unresolved IPs")
 	)
 	flag.Parse()
 
@@ -47,6 +92,18 @@ func main() {
 		console = level.NewFilter(console, loglevel)
 	}
 
+	var (
+		registry = newRegistry()
+		auto     = promauto.With(registry)
+	)
+
+	telemetryErrors := auto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "breakfast_solutions",
+		Subsystem: "service",
+		Name:      "telemetry_errors_total",
+		Help:      "Errors sending logs and traces, by pipeline.",
+	}, []string{"pipeline"})
+
 	var structured log.Logger
 	{
 		if *oklogAddr != "" {
@@ -56,7 +113,7 @@ func main() {
 				os.Exit(1)
 			}
 			defer conn.Close()
-			structured = log.NewJSONLogger(conn)
+			structured = countingLogger{log.NewJSONLogger(conn), telemetryErrors.WithLabelValues("logging")}
 			level.Info(console).Log("logging", "enabled", "oklog", *oklogAddr)
 		} else {
 			structured = log.NewNopLogger()
@@ -65,15 +122,77 @@ func main() {
 	}
 
 	var (
-		duration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		duration = auto.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: "breakfast_solutions",
 			Subsystem: "service",
 			Name:      "request_duration_seconds",
 			Help:      "Duration of each phase of a request in seconds.",
 			Buckets:   prometheus.DefBuckets,
 		}, []string{"component", "operation", "success"})
+		breakerState = auto.NewGauge(prometheus.GaugeOpts{
+			Namespace: "breakfast_solutions",
+			Subsystem: "service",
+			Name:      "circuit_breaker_state",
+			Help:      "State of the repository circuit breaker: 0 closed, 1 half-open, 2 open.",
+		})
+		ratings = auto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "breakfast_solutions",
+			Subsystem: "service",
+			Name:      "ratings_submitted_total",
+			Help:      "Breakfast ratings successfully submitted, by rating.",
+		}, []string{"rating"})
+		favorites = auto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "breakfast_solutions",
+			Subsystem: "service",
+			Name:      "favorites_changed_total",
+			Help:      "Favorites successfully added or removed, by action.",
+		}, []string{"action"})
+		notModified = auto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "breakfast_solutions",
+			Subsystem: "service",
+			Name:      "not_modified_total",
+			Help:      "Conditional requests answered with 304 Not Modified, by operation.",
+		}, []string{"operation"})
+		requests = auto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "breakfast_solutions",
+			Subsystem: "service",
+			Name:      "requests_total",
+			Help:      "API requests served, by method, operation and status code class.",
+		}, []string{"method", "operation", "code"})
+		inFlight = auto.NewGauge(prometheus.GaugeOpts{
+			Namespace: "breakfast_solutions",
+			Subsystem: "service",
+			Name:      "requests_in_flight",
+			Help:      "API requests currently being served.",
+		})
+		requestSize = auto.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "breakfast_solutions",
+			Subsystem: "service",
+			Name:      "request_size_bytes",
+			Help:      "Size of API request bodies in bytes.",
+			Buckets:   prometheus.ExponentialBuckets(100, 10, 6),
+		}, []string{"operation"})
+		responseSize = auto.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "breakfast_solutions",
+			Subsystem: "service",
+			Name:      "response_size_bytes",
+			Help:      "Size of API response bodies in bytes, as sent.",
+			Buckets:   prometheus.ExponentialBuckets(100, 10, 6),
+		}, []string{"operation"})
 	)
 
+	{
+		if *sloConfig != "" {
+			slos, err := loadSLOs(*sloConfig, prometheus.DefBuckets)
+			if err != nil {
+				level.Error(console).Log("err", err)
+				os.Exit(1)
+			}
+			registry.MustRegister(newSLOCollector(slos, duration))
+			level.Info(console).Log("slos", len(slos), "config", *sloConfig)
+		}
+	}
+
 	{
 		if *jaegerAddr != "" {
 			transport, err := jaeger.NewUDPTransport(*jaegerAddr, 0)
@@ -89,7 +208,7 @@ func main() {
 			}
 			closer, err := cfg.InitGlobalTracer(
 				"breakfast_solutions",
-				jaegerconfig.Logger(logAdapter{console}),
+				jaegerconfig.Logger(logAdapter{console, telemetryErrors.WithLabelValues("tracing")}),
 				jaegerconfig.Metrics(jaegermetrics.NullFactory),
 				jaegerconfig.Reporter(jaeger.NewRemoteReporter(transport)),
 			)
@@ -104,37 +223,215 @@ func main() {
 		}
 	}
 
-	var pre preprocessor
+	var geo *geoIP
+	{
+		if *geoipDB != "" {
+			var err error
+			geo, err = openGeoIP(*geoipDB)
+			if err != nil {
+				level.Error(console).Log("err", err)
+				os.Exit(1)
+			}
+			defer geo.Close()
+			level.Info(console).Log("geoip", *geoipDB)
+		}
+	}
+
+	var audit *auditPublisher
+	{
+		if *auditSinkURL != "" {
+			if *auditQueue < 1 {
+				level.Error(console).Log("flag", "audit.queue", "err", "must be at least 1, or every event is dropped")
+				os.Exit(1)
+			}
+			sink, err := newAuditSink(*auditSinkURL)
+			if err != nil {
+				level.Error(console).Log("flag", "audit.sink", "err", err)
+				os.Exit(1)
+			}
+			audit = newAuditPublisher(sink, *auditQueue,
+				auto.NewCounterVec(prometheus.CounterOpts{
+					Namespace: "breakfast_solutions",
+					Subsystem: "audit",
+					Name:      "events_total",
+					Help:      "Audit events, by result: published, failed or dropped.",
+				}, []string{"result"}),
+				console,
+			)
+			auto.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: "breakfast_solutions",
+				Subsystem: "audit",
+				Name:      "queue_length",
+				Help:      "Audit events waiting to be published.",
+			}, func() float64 { return float64(len(audit.queue)) })
+			level.Info(console).Log("audit", *auditSinkURL)
+		}
+	}
+
+	var (
+		pre  preprocessor
+		post postprocessor
+	)
 	{
-		pre = geoPreprocess
-		pre = loggingPreprocessMiddleware(pre)
-		pre = metricsPreprocessMiddleware(pre)
-		pre = tracingPreprocessMiddleware(pre)
+		var (
+			deps = stageDeps{geo: geo, buckets: *buckets, audit: audit}
+			err  error
+		)
+		pre, err = newPreprocessorChain(parseStages(*preStages), deps)
+		if err != nil {
+			level.Error(console).Log("flag", "pre", "err", err)
+			os.Exit(1)
+		}
+		post, err = newPostprocessorChain(parseStages(*postStages), deps)
+		if err != nil {
+			level.Error(console).Log("flag", "post", "err", err)
+			os.Exit(1)
+		}
+		level.Info(console).Log("pre", *preStages, "post", *postStages)
+	}
+
+	var sessStore sessionStore
+	{
+		if *sessions != "" {
+			s, err := newFileSessionStore(*sessions)
+			if err != nil {
+				level.Error(console).Log("err", err)
+				os.Exit(1)
+			}
+			sessStore = s
+			level.Info(console).Log("sessions", *sessions)
+		} else {
+			sessStore = newMemorySessionStore()
+			level.Info(console).Log("sessions", "in-memory")
+		}
+	}
+
+	var data *fileRepository
+	{
+		data = mustNewRepository(*db, *seed, sessStore)
 	}
 
 	var repo repository
 	{
-		repo = mustNewRepository(*db)
+		repo = data
+		if *failures > 0 {
+			if *probes < 1 {
+				level.Error(console).Log("flag", "breaker.probes", "err", "must be at least 1, or the breaker can never close")
+				os.Exit(1)
+			}
+			repo = newBreakerRepoMiddleware(repo, breakerConfig{*failures, *timeout, *probes}, breakerState, console)
+		}
+		repo = countingRepoMiddleware{repo, ratings, favorites}
 		repo = loggingRepoMiddleware{repo}
 		repo = metricsRepoMiddleware{repo}
 		repo = tracingRepoMiddleware{repo}
 	}
 
-	var post postprocessor
+	var search searcher
+	{
+		index := newSearchIndex()
+		data.subscribe(index.rebuild)
+		search = index
+		search = loggingSearchMiddleware{search}
+		search = metricsSearchMiddleware{search}
+		search = tracingSearchMiddleware{search}
+	}
+
+	var imgStore imageStore
 	{
-		post = basicPostprocess
-		post = loggingPostprocessMiddleware(post)
-		post = metricsPostprocessMiddleware(post)
-		post = tracingPostprocessMiddleware(post)
+		if *s3Bucket != "" {
+			s, err := newS3ImageStore(*s3Endpoint, *s3Bucket, *s3Region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+			if err != nil {
+				level.Error(console).Log("err", err)
+				os.Exit(1)
+			}
+			imgStore = s
+			level.Info(console).Log("images", "s3", "endpoint", *s3Endpoint, "bucket", *s3Bucket)
+		} else {
+			s, err := newLocalImageStore(*images)
+			if err != nil {
+				level.Error(console).Log("err", err)
+				os.Exit(1)
+			}
+			imgStore = s
+			level.Info(console).Log("images", *images)
+		}
+		imgStore = loggingImageMiddleware{imgStore}
+		imgStore = metricsImageMiddleware{imgStore}
+		imgStore = tracingImageMiddleware{imgStore}
+	}
+
+	var resize resizer
+	{
+		r, err := newCachingResizer(imgStore, *imageCache)
+		if err != nil {
+			level.Error(console).Log("err", err)
+			os.Exit(1)
+		}
+		resize = r
+		resize = loggingResizeMiddleware{resize}
+		resize = metricsResizeMiddleware{resize}
+		resize = tracingResizeMiddleware{resize}
+	}
+
+	var stats *popularity
+	{
+		stats = newPopularity(*statsIDs,
+			auto.NewCounterVec(prometheus.CounterOpts{
+				Namespace: "breakfast_solutions",
+				Subsystem: "breakfasts",
+				Name:      "served_by_id_total",
+				Help:      "Breakfasts served, by ID; IDs beyond the cap are counted as other.",
+			}, []string{"id"}),
+			auto.NewCounterVec(prometheus.CounterOpts{
+				Namespace: "breakfast_solutions",
+				Subsystem: "breakfasts",
+				Name:      "served_total",
+				Help:      "Breakfasts served, by region and how they were requested.",
+			}, []string{"region", "via"}),
+		)
+	}
+
+	var success successPolicy
+	{
+		var err error
+		success, err = parseSuccessPolicy(*successes)
+		if err != nil {
+			level.Error(console).Log("flag", "api.success", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var proxies trustedProxies
+	{
+		var err error
+		proxies, err = parseTrustedProxies(*proxyNets)
+		if err != nil {
+			level.Error(console).Log("flag", "proxy.trusted", "err", err)
+			os.Exit(1)
+		}
 	}
 
 	var api http.Handler
 	{
-		api = newAPI(pre, repo, post, *images)
+		a := newAPI(pre, repo, search, imgStore, resize, post, stats, *maxImage, proxies)
+		route := newRouteNamer(a.Router)
+		api = a
+		if *debug {
+			api = regionHintAPIMiddleware(api)
+		}
 		api = hstsAPIMiddleware(api)
-		api = loggingAPIMiddleware(api, structured)
-		api = metricsAPIMiddleware(api, duration)
-		api = tracingAPIMiddleware(api)
+		api = compressAPIMiddleware(api)
+		api = loggingAPIMiddleware(api, structured, route)
+		api = metricsAPIMiddleware(api, apiMetrics{
+			duration:     duration,
+			notModified:  notModified,
+			requests:     requests,
+			inFlight:     inFlight,
+			requestSize:  requestSize,
+			responseSize: responseSize,
+		}, success, route)
+		api = tracingAPIMiddleware(api, success, route)
 	}
 
 	var g run.Group
@@ -151,7 +448,10 @@ func main() {
 	}
 	{
 		mux := http.NewServeMux()
-		mux.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/metrics", promhttp.InstrumentMetricHandler(
+			registry,
+			promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true}), // for exemplars
+		))
 		server := &http.Server{Addr: *promAddr, Handler: mux}
 		g.Add(func() error {
 			level.Info(console).Log("prometheus_addr", *promAddr)
@@ -162,6 +462,54 @@ func main() {
 			server.Shutdown(ctx)
 		})
 	}
+	if audit != nil {
+		g.Add(audit.run, func(error) {
+			audit.stop()
+		})
+	}
+	if *reload > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			ticker := time.NewTicker(*reload)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if changed, err := data.reload(); err != nil {
+						level.Error(console).Log("db", *db, "reload", "failed", "err", err)
+					} else if changed {
+						level.Info(console).Log("db", *db, "reload", "success")
+					}
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}, func(error) {
+			cancel()
+		})
+	}
+	if *recommend > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			ticker := time.NewTicker(*recommend)
+			defer ticker.Stop()
+			for {
+				begin := time.Now()
+				if err := data.refreshRecommendations(); err != nil {
+					level.Error(console).Log("recommendations", "failed", "err", err)
+				} else {
+					level.Debug(console).Log("recommendations", "refreshed", "took", time.Since(begin))
+				}
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}, func(error) {
+			cancel()
+		})
+	}
 	{
 		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
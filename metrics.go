@@ -3,66 +3,167 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-func metricsAPIMiddleware(next http.Handler, duration *prometheus.HistogramVec) http.Handler {
+// apiMetrics are the request-level metrics recorded by metricsAPIMiddleware.
+type apiMetrics struct {
+	duration     *prometheus.HistogramVec // by component, operation, success
+	notModified  *prometheus.CounterVec   // by operation
+	requests     *prometheus.CounterVec   // by method, operation, code class
+	inFlight     prometheus.Gauge
+	requestSize  *prometheus.HistogramVec // by operation
+	responseSize *prometheus.HistogramVec // by operation
+}
+
+func metricsAPIMiddleware(next http.Handler, m apiMetrics, success successPolicy, route routeNamer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var (
-			iw  = &interceptingWriter{0, http.StatusOK, w}
-			ctx = context.WithValue(r.Context(), contextHistogramKey{}, duration)
+			iw        = &interceptingWriter{0, http.StatusOK, w}
+			cr        = &countingReader{ReadCloser: r.Body}
+			ctx       = context.WithValue(r.Context(), contextHistogramKey{}, m.duration)
+			operation = route(r)
 		)
+		if r.Body != nil {
+			r.Body = cr
+		}
+		m.inFlight.Inc()
 		defer func(begin time.Time) {
-			duration.WithLabelValues(
-				"API", normalize(r.URL.Path), fmt.Sprint(iw.code == 200),
-			).Observe(time.Since(begin).Seconds())
+			m.inFlight.Dec()
+			if iw.code == http.StatusNotModified {
+				m.notModified.WithLabelValues(operation).Inc()
+			}
+			observe(ctx, m.duration.WithLabelValues(
+				"API", operation, fmt.Sprint(success.success(operation, iw.code)),
+			), time.Since(begin).Seconds())
+			m.requests.WithLabelValues(r.Method, operation, codeClass(iw.code)).Inc()
+			requestSize := r.ContentLength
+			if requestSize < 0 {
+				requestSize = cr.count
+			}
+			observe(ctx, m.requestSize.WithLabelValues(operation), float64(requestSize))
+			observe(ctx, m.responseSize.WithLabelValues(operation), float64(iw.count))
 		}(time.Now())
 		next.ServeHTTP(iw, r.WithContext(ctx))
 	})
 }
 
-func metricsPreprocessMiddleware(next preprocessor) preprocessor {
-	return func(ctx context.Context, region string) context.Context {
+// codeClass turns e.g. 404 into "4xx".
+func codeClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// countingReader counts the bytes read from a request body, for requests
+// that don't declare a Content-Length.
+type countingReader struct {
+	count int64
+	io.ReadCloser
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.count += int64(n)
+	return n, err
+}
+
+func metricsPreprocessMiddleware(next preprocessor, stage string) preprocessor {
+	return func(ctx context.Context, originIP string) context.Context {
 		defer func(begin time.Time) {
-			getContextHistogram(ctx).WithLabelValues(
-				"preprocessor", "preprocess", "true",
-			).Observe(time.Since(begin).Seconds())
+			observe(ctx, getContextHistogram(ctx).WithLabelValues(
+				"preprocessor", stage, "true",
+			), time.Since(begin).Seconds())
 		}(time.Now())
-		return next(ctx, region)
+		return next(ctx, originIP)
+	}
+}
+
+// countingRepoMiddleware counts successful ratings and favorites. Other
+// methods pass straight through to the embedded repository.
+type countingRepoMiddleware struct {
+	repository
+	ratings   *prometheus.CounterVec // by rating
+	favorites *prometheus.CounterVec // by action
+}
+
+func (m countingRepoMiddleware) rateBreakfast(ctx context.Context, username string, breakfastID uint64, rating int) (breakfast, error) {
+	b, err := m.repository.rateBreakfast(ctx, username, breakfastID, rating)
+	if err == nil {
+		m.ratings.WithLabelValues(strconv.Itoa(rating)).Inc()
+	}
+	return b, err
+}
+
+func (m countingRepoMiddleware) setFavorite(ctx context.Context, username string, breakfastID uint64, favorite bool) error {
+	err := m.repository.setFavorite(ctx, username, breakfastID, favorite)
+	if err == nil {
+		action := "add"
+		if !favorite {
+			action = "remove"
+		}
+		m.favorites.WithLabelValues(action).Inc()
 	}
+	return err
 }
 
-type metricsRepoMiddleware struct {
-	next repository
+type metricsSearchMiddleware struct {
+	next searcher
 }
 
-func (m metricsRepoMiddleware) getBreakfast(ctx context.Context, username string, breakfastID uint64) (b breakfast, err error) {
+func (m metricsSearchMiddleware) search(ctx context.Context, query string) (results []searchResult, err error) {
 	defer func(begin time.Time) {
-		getContextHistogram(ctx).WithLabelValues(
-			"DB", "getBreakfast", fmt.Sprint(err == nil),
-		).Observe(time.Since(begin).Seconds())
+		observe(ctx, getContextHistogram(ctx).WithLabelValues(
+			"search", "search", fmt.Sprint(err == nil),
+		), time.Since(begin).Seconds())
 	}(time.Now())
-	return m.next.getBreakfast(ctx, username, breakfastID)
+	return m.next.search(ctx, query)
 }
 
-func (m metricsRepoMiddleware) getRandomBreakfast(ctx context.Context, username string) (b breakfast, err error) {
+type metricsImageMiddleware struct {
+	next imageStore
+}
+
+func (m metricsImageMiddleware) putImage(ctx context.Context, key, contentType string, data []byte) (err error) {
+	defer func(begin time.Time) {
+		observe(ctx, getContextHistogram(ctx).WithLabelValues(
+			"images", "putImage", fmt.Sprint(err == nil),
+		), time.Since(begin).Seconds())
+	}(time.Now())
+	return m.next.putImage(ctx, key, contentType, data)
+}
+
+func (m metricsImageMiddleware) getImage(ctx context.Context, key string) (rc io.ReadCloser, contentType string, modTime time.Time, err error) {
 	defer func(begin time.Time) {
-		getContextHistogram(ctx).WithLabelValues(
-			"DB", "getRandomBreakfast", fmt.Sprint(err == nil),
-		).Observe(time.Since(begin).Seconds())
+		observe(ctx, getContextHistogram(ctx).WithLabelValues(
+			"images", "getImage", fmt.Sprint(err == nil),
+		), time.Since(begin).Seconds())
 	}(time.Now())
-	return m.next.getRandomBreakfast(ctx, username)
+	return m.next.getImage(ctx, key)
+}
+
+type metricsResizeMiddleware struct {
+	next resizer
 }
 
-func metricsPostprocessMiddleware(next postprocessor) postprocessor {
+func (m metricsResizeMiddleware) resize(ctx context.Context, key string, width, height int) (data []byte, contentType string, cached bool, err error) {
+	defer func(begin time.Time) {
+		observe(ctx, getContextHistogram(ctx).WithLabelValues(
+			"resizer", "resize", fmt.Sprint(err == nil),
+		), time.Since(begin).Seconds())
+	}(time.Now())
+	return m.next.resize(ctx, key, width, height)
+}
+
+func metricsPostprocessMiddleware(next postprocessor, stage string) postprocessor {
 	return func(ctx context.Context, username string, success bool) context.Context {
 		defer func(begin time.Time) {
-			getContextHistogram(ctx).WithLabelValues(
-				"postprocessor", "postprocess", fmt.Sprint(success),
-			).Observe(time.Since(begin).Seconds())
+			observe(ctx, getContextHistogram(ctx).WithLabelValues(
+				"postprocessor", stage, fmt.Sprint(success),
+			), time.Since(begin).Seconds())
 		}(time.Now())
 		return next(ctx, username, success)
 	}
@@ -72,6 +173,18 @@ func metricsPostprocessMiddleware(next postprocessor) postprocessor {
 //
 //
 
+// observe records v, with the trace ID of the sampled span in ctx as an
+// exemplar, if there is one.
+func observe(ctx context.Context, o prometheus.Observer, v float64) {
+	if traceID, sampled := getTraceID(ctx); sampled {
+		if eo, ok := o.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": traceID})
+			return
+		}
+	}
+	o.Observe(v)
+}
+
 type contextHistogramKey struct{}
 
 func getContextHistogram(ctx context.Context) *prometheus.HistogramVec {
@@ -3,10 +3,12 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"strings"
+	"regexp"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func hstsAPIMiddleware(next http.Handler) http.Handler {
@@ -32,18 +34,55 @@ func (iw *interceptingWriter) Write(p []byte) (int, error) {
 	return iw.ResponseWriter.Write(p)
 }
 
-func normalize(path string) string {
-	switch {
-	case path == "" || path == "/":
-		return "/"
-	default:
-		return "/" + strings.FieldsFunc(path, func(r rune) bool { return r == '/' })[0]
+// routeNamer names a request by the template of the route it matches, like
+// "/breakfasts/{id}", for use in metric labels, logs and span names.
+// Requests that match no route are all named "other", to bound cardinality.
+type routeNamer func(r *http.Request) string
+
+var routeVariablePattern = regexp.MustCompile(`\{([^:}]+):[^}]*\}`)
+
+func newRouteNamer(router *mux.Router) routeNamer {
+	return func(r *http.Request) string {
+		var match mux.RouteMatch
+		if !router.Match(r, &match) || match.Route == nil {
+			return "other"
+		}
+		return routeName(match.Route)
+	}
+}
+
+// routeName is the path template of route without variable patterns, e.g.
+// "/breakfasts/{id}" rather than "/breakfasts/{id:[0-9]+}".
+func routeName(route *mux.Route) string {
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return "other"
 	}
+	return routeVariablePattern.ReplaceAllString(template, "{$1}")
 }
 
-type logAdapter struct{ log.Logger }
+// countingLogger counts the errors from its logger, which callers ignore,
+// so a broken logging pipeline still shows up in metrics.
+type countingLogger struct {
+	log.Logger
+	errors prometheus.Counter
+}
+
+func (l countingLogger) Log(keyvals ...interface{}) error {
+	err := l.Logger.Log(keyvals...)
+	if err != nil {
+		l.errors.Inc()
+	}
+	return err
+}
+
+type logAdapter struct {
+	log.Logger
+	errors prometheus.Counter
+}
 
 func (a logAdapter) Error(msg string) {
+	a.errors.Inc()
 	level.Error(a.Logger).Log("component", "Jaeger", "msg", msg)
 }
 
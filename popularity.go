@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// How a breakfast came to be served.
+const (
+	servedRandom    = "random"
+	servedPermalink = "permalink"
+	servedToday     = "today"
+)
+
+// popularity counts the breakfasts served by the API. Each breakfast ID
+// gets its own label value only until maxIDs have been seen, and the rest
+// are counted as "other", so the metrics stay bounded however large the
+// database grows. The in-process counts behind /stats aren't capped.
+type popularity struct {
+	maxIDs   int
+	byID     *prometheus.CounterVec // by id
+	byOrigin *prometheus.CounterVec // by region, via
+
+	mtx     sync.Mutex
+	labeled map[uint64]bool
+	counts  map[uint64]int
+	names   map[uint64]string
+}
+
+func newPopularity(maxIDs int, byID, byOrigin *prometheus.CounterVec) *popularity {
+	return &popularity{
+		maxIDs:   maxIDs,
+		byID:     byID,
+		byOrigin: byOrigin,
+		labeled:  map[uint64]bool{},
+		counts:   map[uint64]int{},
+		names:    map[uint64]string{},
+	}
+}
+
+func (p *popularity) served(b breakfast, region, via string) {
+	p.mtx.Lock()
+	if !p.labeled[b.ID] && len(p.labeled) < p.maxIDs {
+		p.labeled[b.ID] = true
+	}
+	id := "other"
+	if p.labeled[b.ID] {
+		id = strconv.FormatUint(b.ID, 10)
+	}
+	p.counts[b.ID]++
+	p.names[b.ID] = b.Name
+	p.mtx.Unlock()
+
+	if !isRegion(region) {
+		region = unknownRegion // keep the label bounded, whatever the caller passes
+	}
+	p.byID.WithLabelValues(id).Inc()
+	p.byOrigin.WithLabelValues(region, via).Inc()
+}
+
+type popularBreakfast struct {
+	ID     uint64 `json:"id"`
+	Name   string `json:"name"`
+	Served int    `json:"served"`
+}
+
+// top returns the n most-served breakfasts since the process started.
+func (p *popularity) top(n int) []popularBreakfast {
+	p.mtx.Lock()
+	a := make([]popularBreakfast, 0, len(p.counts))
+	for id, count := range p.counts {
+		a = append(a, popularBreakfast{id, p.names[id], count})
+	}
+	p.mtx.Unlock()
+
+	sort.Slice(a, func(i, j int) bool {
+		if a[i].Served != a[j].Served {
+			return a[i].Served > a[j].Served
+		}
+		return a[i].ID < a[j].ID
+	})
+	if len(a) > n {
+		a = a[:n]
+	}
+	return a
+}
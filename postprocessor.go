@@ -16,3 +16,25 @@ func basicPostprocess(ctx context.Context, username string, success bool) contex
 	time.Sleep(time.Duration(d+rand.Intn(d)) * time.Millisecond)
 	return ctx
 }
+
+// newAuditPostprocessor publishes an event for each request that served,
+// or tried to serve, a particular breakfast.
+func newAuditPostprocessor(p *auditPublisher) postprocessor {
+	return func(ctx context.Context, username string, success bool) context.Context {
+		id, ok := getContextBreakfastID(ctx)
+		if !ok {
+			return ctx
+		}
+		traceID, _ := getTraceID(ctx)
+		p.enqueue(auditEvent{
+			Type:        "breakfast_served",
+			Time:        time.Now().UTC(),
+			Username:    username,
+			BreakfastID: id,
+			Region:      getContextRegion(ctx),
+			Success:     success,
+			TraceID:     traceID,
+		})
+		return ctx
+	}
+}
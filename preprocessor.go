@@ -2,20 +2,32 @@ package main
 
 import (
 	"context"
-	"strings"
+	"net"
 	"time"
 )
 
 type preprocessor func(ctx context.Context, originIP string) context.Context
 
-func geoPreprocess(ctx context.Context, region string) context.Context {
-	var delay time.Duration
-	switch strings.ToLower(region) {
-	case "au":
-		delay = 100 * time.Millisecond
-	default:
-		delay = 1 * time.Millisecond
+// newGeoPreprocessor resolves the region of the origin IP, and stores it in
+// the returned context. If geo is nil, or can't resolve the IP, the region
+// hint is used, if any. Then it simulates region-dependent work.
+func newGeoPreprocessor(geo *geoIP) preprocessor {
+	return func(ctx context.Context, originIP string) context.Context {
+		region := geo.region(net.ParseIP(originIP))
+		if hint := getContextRegionHint(ctx); hint != "" && region == unknownRegion {
+			region = hint
+		}
+		ctx = withRegion(ctx, region)
+		ctx = withOriginIP(ctx, originIP)
+
+		var delay time.Duration
+		switch region {
+		case "au":
+			delay = 100 * time.Millisecond
+		default:
+			delay = 1 * time.Millisecond
+		}
+		time.Sleep(delay)
+		return ctx
 	}
-	time.Sleep(delay)
-	return ctx
 }
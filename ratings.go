@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+)
+
+type ratingSummary struct {
+	count int
+	sum   int
+}
+
+func summarizeRatings(sessions map[string]session) map[uint64]ratingSummary {
+	ratings := map[uint64]ratingSummary{}
+	for _, sess := range sessions {
+		for id, rating := range sess.Ratings {
+			s := ratings[id]
+			s.count++
+			s.sum += rating
+			ratings[id] = s
+		}
+	}
+	return ratings
+}
+
+// rateBreakfast records the user's rating, replacing any previous one, and
+// returns the breakfast with its updated average.
+func (repo *fileRepository) rateBreakfast(_ context.Context, username string, breakfastID uint64, rating int) (breakfast, error) {
+	fakeDatabaseOperation(username)
+	if rating < 1 || rating > 5 {
+		return breakfast{}, errInvalidRating
+	}
+	b, ok := repo.find(breakfastID)
+	if !ok {
+		return breakfast{}, notFoundError{breakfastID}
+	}
+
+	repo.mtx.Lock()
+	defer repo.mtx.Unlock()
+
+	sess, err := repo.sessions.getSession(username)
+	if err != nil {
+		return breakfast{}, err
+	}
+	previous, rerated := sess.Ratings[breakfastID]
+	if sess.Ratings == nil {
+		sess.Ratings = map[uint64]int{}
+	}
+	sess.Ratings[breakfastID] = rating
+	if err := repo.sessions.putSession(username, sess); err != nil {
+		return breakfast{}, err
+	}
+
+	repo.statsMtx.Lock()
+	s := repo.ratings[breakfastID]
+	if rerated {
+		s.sum -= previous
+	} else {
+		s.count++
+	}
+	s.sum += rating
+	repo.ratings[breakfastID] = s
+	repo.statsMtx.Unlock()
+
+	return repo.decorate(b), nil
+}
+
+// setFavorite adds the breakfast to, or removes it from, the user's favorites.
+func (repo *fileRepository) setFavorite(_ context.Context, username string, breakfastID uint64, favorite bool) error {
+	fakeDatabaseOperation(username)
+	if _, ok := repo.find(breakfastID); !ok {
+		return notFoundError{breakfastID}
+	}
+
+	repo.mtx.Lock()
+	defer repo.mtx.Unlock()
+
+	sess, err := repo.sessions.getSession(username)
+	if err != nil {
+		return err
+	}
+	var favorites []uint64
+	for _, id := range sess.Favorites {
+		if id != breakfastID {
+			favorites = append(favorites, id)
+		}
+	}
+	if favorite {
+		favorites = append(favorites, breakfastID)
+	}
+	sess.Favorites = favorites
+	return repo.sessions.putSession(username, sess)
+}
+
+// getFavorites returns the user's favorites, most recently added first.
+// Favorites that no longer exist in the database are skipped.
+func (repo *fileRepository) getFavorites(_ context.Context, username string) ([]breakfast, error) {
+	fakeDatabaseOperation(username)
+	sess, err := repo.sessions.getSession(username)
+	if err != nil {
+		return nil, err
+	}
+	var favorites []breakfast
+	for i := len(sess.Favorites) - 1; i >= 0; i-- {
+		if b, ok := repo.find(sess.Favorites[i]); ok {
+			favorites = append(favorites, repo.decorate(b))
+		}
+	}
+	return favorites, nil
+}
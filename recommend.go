@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const (
+	likedRating    = 4 // ratings at or above this count as a like
+	relatedPerItem = 3 // max related breakfasts kept per breakfast
+	defaultRating  = 2.5
+)
+
+func (repo *fileRepository) recordView(breakfastID uint64) {
+	repo.statsMtx.Lock()
+	defer repo.statsMtx.Unlock()
+	repo.views[breakfastID]++
+}
+
+// pickPopular makes a weighted random choice, where more-viewed and
+// better-rated breakfasts are more likely. Unrated breakfasts get a middling
+// rating, and every breakfast keeps a nonzero chance.
+func (repo *fileRepository) pickPopular(rng *rand.Rand, a []breakfast) breakfast {
+	repo.statsMtx.RLock()
+	weights := make([]float64, len(a))
+	var total float64
+	for i, b := range a {
+		rating := defaultRating
+		if s := repo.ratings[b.ID]; s.count > 0 {
+			rating = float64(s.sum) / float64(s.count)
+		}
+		weights[i] = math.Log2(2+float64(repo.views[b.ID])) * rating
+		total += weights[i]
+	}
+	repo.statsMtx.RUnlock()
+
+	x := rng.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return a[i]
+		}
+		x -= w
+	}
+	return a[len(a)-1]
+}
+
+// refreshRecommendations recomputes, for each breakfast, which other
+// breakfasts were most often liked by the same users. A user likes a
+// breakfast if they rated it highly or marked it as a favorite. It's too
+// expensive to do per request, so it's meant to run periodically in the
+// background.
+func (repo *fileRepository) refreshRecommendations() error {
+	sessions, err := repo.sessions.allSessions()
+	if err != nil {
+		return err
+	}
+
+	cooccurrences := map[uint64]map[uint64]int{}
+	for _, sess := range sessions {
+		liked := map[uint64]bool{}
+		for id, rating := range sess.Ratings {
+			if rating >= likedRating {
+				liked[id] = true
+			}
+		}
+		for _, id := range sess.Favorites {
+			liked[id] = true
+		}
+		for x := range liked {
+			for y := range liked {
+				if x == y {
+					continue
+				}
+				if cooccurrences[x] == nil {
+					cooccurrences[x] = map[uint64]int{}
+				}
+				cooccurrences[x][y]++
+			}
+		}
+	}
+
+	related := make(map[uint64][]uint64, len(cooccurrences))
+	for x, counts := range cooccurrences {
+		ids := make([]uint64, 0, len(counts))
+		for y := range counts {
+			ids = append(ids, y)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			if counts[ids[i]] != counts[ids[j]] {
+				return counts[ids[i]] > counts[ids[j]]
+			}
+			return ids[i] < ids[j]
+		})
+		if len(ids) > relatedPerItem {
+			ids = ids[:relatedPerItem]
+		}
+		related[x] = ids
+	}
+
+	repo.statsMtx.Lock()
+	defer repo.statsMtx.Unlock()
+	repo.related = related
+	return nil
+}
+
+// getRelatedBreakfasts returns breakfasts liked by users who also liked the
+// given breakfast, as of the last refreshRecommendations. They're served
+// from memory, so unlike other methods it doesn't pay for a database trip.
+func (repo *fileRepository) getRelatedBreakfasts(_ context.Context, _ string, breakfastID uint64) ([]breakfast, error) {
+	repo.statsMtx.RLock()
+	ids := repo.related[breakfastID]
+	repo.statsMtx.RUnlock()
+
+	var related []breakfast
+	for _, id := range ids {
+		if b, ok := repo.find(id); ok {
+			related = append(related, repo.decorate(b))
+		}
+	}
+	return related, nil
+}
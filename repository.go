@@ -5,15 +5,30 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
+// The logging, metrics and tracing middlewares for repository are generated
+// from it; edit fieldsByType in gen_decorators.go to change what they record.
+//
+//go:generate go run gen_decorators.go -type repository -name Repo -component DB -log.prefix db_ -span db_request -output repository_decorators.go
 type repository interface {
 	getBreakfast(ctx context.Context, username string, breakfastID uint64) (breakfast, error)
-	getRandomBreakfast(ctx context.Context, username string) (breakfast, error)
+	listBreakfasts(ctx context.Context, username string, f breakfastFilter) ([]breakfast, error)
+	getRandomBreakfast(ctx context.Context, username string, q randomQuery) (breakfast, choiceReason, error)
+	getBreakfastOfTheDay(ctx context.Context, username string, t time.Time) (breakfast, error)
+	rateBreakfast(ctx context.Context, username string, breakfastID uint64, rating int) (breakfast, error)
+	setFavorite(ctx context.Context, username string, breakfastID uint64, favorite bool) error
+	getFavorites(ctx context.Context, username string) ([]breakfast, error)
+	getRelatedBreakfasts(ctx context.Context, username string, breakfastID uint64) ([]breakfast, error)
+	setBreakfastImage(ctx context.Context, username string, breakfastID uint64, image string) (breakfast, error)
 }
 
 type breakfast struct {
@@ -21,42 +36,371 @@ type breakfast struct {
 	Name        string `json:"name"`
 	Image       string `json:"image"`
 	Description string `json:"description"`
+
+	// Optional, so older breakfast files still load.
+	Tags     []string `json:"tags,omitempty"`     // e.g. sweet, savory, vegan
+	Cuisine  string   `json:"cuisine,omitempty"`  // e.g. american, japanese
+	Calories int      `json:"calories,omitempty"` // zero means unknown
+
+	// Computed by the repository from user ratings, not read from the file.
+	AverageRating float64 `json:"average_rating,omitempty"`
+	RatingCount   int     `json:"rating_count,omitempty"`
 }
 
-type breakfasts []breakfast
+func (b breakfast) hasTag(tag string) bool {
+	for _, t := range b.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// randomQuery parameterizes getRandomBreakfast.
+type randomQuery struct {
+	seed   int64 // nonzero makes the pick deterministic
+	filter breakfastFilter
+	mode   selectionMode
+}
+
+type selectionMode string
+
+const (
+	modeCycle   selectionMode = "cycle"   // every breakfast once per user, then repeat
+	modePopular selectionMode = "popular" // weighted by views and ratings
+)
+
+// choiceReason records why getRandomBreakfast picked what it did.
+type choiceReason string
+
+const (
+	choiceSeeded   choiceReason = "seeded"    // determined by the request seed
+	choiceRandom   choiceReason = "random"    // uniform, for anonymous users
+	choiceUnseen   choiceReason = "unseen"    // not yet seen in the user's current cycle
+	choiceNewCycle choiceReason = "new_cycle" // user has seen them all, starting over
+	choicePopular  choiceReason = "popular"   // weighted by views and ratings
+)
+
+// fileRepository serves breakfasts loaded from a JSON file.
+type fileRepository struct {
+	filename string
+	sessions sessionStore
+
+	dataMtx     sync.RWMutex
+	breakfasts  []breakfast // replaced wholesale, never modified in place
+	modTime     time.Time
+	subscribers []func([]breakfast)
 
-func newRepository(filename string) (a breakfasts, err error) {
-	buf, err := ioutil.ReadFile(filename)
+	statsMtx sync.RWMutex
+	ratings  map[uint64]ratingSummary
+	views    map[uint64]int
+	related  map[uint64][]uint64 // see refreshRecommendations
+
+	mtx sync.Mutex // serializes session updates
+	rng *rand.Rand
+}
+
+// newRepository loads breakfasts from filename. A nonzero seed makes the
+// sequence of random breakfasts reproducible. Per-user histories, ratings
+// and favorites are kept in sessions.
+func newRepository(filename string, seed int64, sessions sessionStore) (*fileRepository, error) {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	all, err := sessions.allSessions()
 	if err != nil {
 		return nil, err
 	}
-	return a, json.Unmarshal(buf, &a)
+	repo := &fileRepository{
+		filename: filename,
+		sessions: sessions,
+		ratings:  summarizeRatings(all),
+		views:    map[uint64]int{},
+		rng:      rand.New(rand.NewSource(seed)),
+	}
+	if _, err := repo.reload(); err != nil {
+		return nil, err
+	}
+	return repo, nil
 }
 
-func mustNewRepository(filename string) breakfasts {
-	a, err := newRepository(filename)
+func mustNewRepository(filename string, seed int64, sessions sessionStore) *fileRepository {
+	repo, err := newRepository(filename, seed, sessions)
 	if err != nil {
 		panic(err)
 	}
-	return a
+	return repo
 }
 
-func (a breakfasts) getBreakfast(_ context.Context, username string, breakfastID uint64) (breakfast, error) {
+// reload re-reads the file if it was modified since it was last read, and
+// notifies subscribers of the new breakfasts. It reports whether it did.
+func (repo *fileRepository) reload() (bool, error) {
+	fi, err := os.Stat(repo.filename)
+	if err != nil {
+		return false, err
+	}
+
+	repo.dataMtx.RLock()
+	unchanged := fi.ModTime().Equal(repo.modTime)
+	repo.dataMtx.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	buf, err := ioutil.ReadFile(repo.filename)
+	if err != nil {
+		return false, err
+	}
+	var a []breakfast
+	if err := json.Unmarshal(buf, &a); err != nil {
+		return false, err
+	}
+
+	repo.dataMtx.Lock()
+	repo.breakfasts, repo.modTime = a, fi.ModTime()
+	subscribers := repo.subscribers
+	repo.dataMtx.Unlock()
+
+	for _, fn := range subscribers {
+		fn(a)
+	}
+	return true, nil
+}
+
+// subscribe calls fn with the current breakfasts, and again whenever they
+// change. The slice passed to fn must not be modified.
+func (repo *fileRepository) subscribe(fn func([]breakfast)) {
+	repo.dataMtx.Lock()
+	repo.subscribers = append(repo.subscribers, fn)
+	a := repo.breakfasts
+	repo.dataMtx.Unlock()
+	fn(a)
+}
+
+// update applies fn to a copy of the breakfasts, writes the result back to
+// the file, and notifies subscribers.
+func (repo *fileRepository) update(fn func(a []breakfast) error) error {
+	repo.dataMtx.Lock()
+	a := make([]breakfast, len(repo.breakfasts))
+	copy(a, repo.breakfasts)
+	if err := fn(a); err != nil {
+		repo.dataMtx.Unlock()
+		return err
+	}
+	buf, err := json.MarshalIndent(a, "", "    ")
+	if err != nil {
+		repo.dataMtx.Unlock()
+		return err
+	}
+	if err := writeFileAtomic(repo.filename, append(buf, '\n')); err != nil {
+		repo.dataMtx.Unlock()
+		return err
+	}
+	if fi, err := os.Stat(repo.filename); err == nil {
+		repo.modTime = fi.ModTime() // so reload doesn't read our own write
+	}
+	repo.breakfasts = a
+	subscribers := repo.subscribers
+	repo.dataMtx.Unlock()
+
+	for _, fn := range subscribers {
+		fn(a)
+	}
+	return nil
+}
+
+// decorate fills in the fields of b that are computed by the repository.
+func (repo *fileRepository) decorate(b breakfast) breakfast {
+	repo.statsMtx.RLock()
+	defer repo.statsMtx.RUnlock()
+	if s := repo.ratings[b.ID]; s.count > 0 {
+		b.AverageRating = math.Round(10*float64(s.sum)/float64(s.count)) / 10
+		b.RatingCount = s.count
+	}
+	return b
+}
+
+func (repo *fileRepository) decorateAll(a []breakfast) []breakfast {
+	decorated := make([]breakfast, len(a))
+	for i, b := range a {
+		decorated[i] = repo.decorate(b)
+	}
+	return decorated
+}
+
+func (repo *fileRepository) all() []breakfast {
+	repo.dataMtx.RLock()
+	defer repo.dataMtx.RUnlock()
+	return repo.breakfasts
+}
+
+func (repo *fileRepository) getBreakfast(_ context.Context, username string, breakfastID uint64) (breakfast, error) {
 	fakeDatabaseOperation(username)
-	for _, b := range a {
+	b, ok := repo.find(breakfastID)
+	if !ok {
+		return breakfast{}, notFoundError{breakfastID}
+	}
+	repo.recordView(b.ID)
+	return repo.decorate(b), nil
+}
+
+func (repo *fileRepository) find(breakfastID uint64) (breakfast, bool) {
+	for _, b := range repo.all() {
 		if b.ID == breakfastID {
-			return b, nil
+			return b, true
+		}
+	}
+	return breakfast{}, false
+}
+
+// listBreakfasts returns every breakfast matching the filter.
+func (repo *fileRepository) listBreakfasts(_ context.Context, username string, f breakfastFilter) ([]breakfast, error) {
+	fakeDatabaseOperation(username)
+	return repo.decorateAll(f.apply(repo.all())), nil
+}
+
+// getRandomBreakfast picks a breakfast matching the filter. In cycle mode,
+// that's one the user hasn't seen yet in their current cycle; in popular
+// mode, it's weighted by views and ratings. A nonzero seed overrides the
+// repository's random source, and fully determines the pick.
+func (repo *fileRepository) getRandomBreakfast(_ context.Context, username string, q randomQuery) (b breakfast, reason choiceReason, err error) {
+	fakeDatabaseOperation(username)
+	all := repo.all()
+	if len(all) <= 0 {
+		return breakfast{}, "", errNoBreakfasts
+	}
+	matched := q.filter.apply(all)
+	if len(matched) <= 0 {
+		return breakfast{}, "", errNoMatchingBreakfasts
+	}
+	defer func() {
+		if err == nil {
+			repo.recordView(b.ID)
+		}
+	}()
+
+	if q.mode == modePopular {
+		rng := repo.rng
+		if q.seed != 0 {
+			rng = rand.New(rand.NewSource(q.seed))
+		}
+		repo.mtx.Lock()
+		defer repo.mtx.Unlock()
+		return repo.decorate(repo.pickPopular(rng, matched)), choicePopular, nil
+	}
+
+	if q.seed != 0 {
+		return repo.decorate(matched[rand.New(rand.NewSource(q.seed)).Intn(len(matched))]), choiceSeeded, nil
+	}
+
+	repo.mtx.Lock()
+	defer repo.mtx.Unlock()
+
+	if username == anonymous {
+		return repo.decorate(matched[repo.rng.Intn(len(matched))]), choiceRandom, nil
+	}
+
+	sess, err := repo.sessions.getSession(username)
+	if err != nil {
+		return breakfast{}, "", err
+	}
+	history := sess.History
+
+	seen := make(map[uint64]bool, len(history))
+	for _, id := range history {
+		seen[id] = true
+	}
+	var candidates []breakfast
+	for _, b := range matched {
+		if !seen[b.ID] {
+			candidates = append(candidates, b)
 		}
 	}
-	return breakfast{}, fmt.Errorf("no breakfast with ID %d", breakfastID)
+
+	reason = choiceUnseen
+	if len(candidates) <= 0 {
+		// Start a new cycle over the matched breakfasts, but don't serve the
+		// last one twice in a row. History outside the filter is kept.
+		reason = choiceNewCycle
+		last := history[len(history)-1]
+		restart := map[uint64]bool{}
+		for _, b := range matched {
+			restart[b.ID] = true
+			if b.ID != last || len(matched) == 1 {
+				candidates = append(candidates, b)
+			}
+		}
+		var kept []uint64
+		for _, id := range history {
+			if !restart[id] {
+				kept = append(kept, id)
+			}
+		}
+		history = kept
+	}
+
+	b = candidates[repo.rng.Intn(len(candidates))]
+	sess.History = append(history, b.ID)
+	if err := repo.sessions.putSession(username, sess); err != nil {
+		return breakfast{}, "", err
+	}
+	return repo.decorate(b), reason, nil
 }
 
-func (a breakfasts) getRandomBreakfast(_ context.Context, username string) (breakfast, error) {
+// getBreakfastOfTheDay picks the same breakfast for every call on the
+// calendar day of t, in t's location.
+func (repo *fileRepository) getBreakfastOfTheDay(_ context.Context, username string, t time.Time) (breakfast, error) {
 	fakeDatabaseOperation(username)
-	if len(a) <= 0 {
-		return breakfast{}, errors.New("no breakfasts available")
+	all := repo.all()
+	if len(all) <= 0 {
+		return breakfast{}, errNoBreakfasts
 	}
-	return a[rand.Intn(len(a))], nil
+	h := fnv.New64a()
+	h.Write([]byte(t.Format("2006-01-02")))
+	b := all[h.Sum64()%uint64(len(all))]
+	repo.recordView(b.ID)
+	return repo.decorate(b), nil
+}
+
+// setBreakfastImage points the breakfast at a new image path, and persists
+// the change to the database file.
+func (repo *fileRepository) setBreakfastImage(_ context.Context, username string, breakfastID uint64, image string) (b breakfast, err error) {
+	fakeDatabaseOperation(username)
+	err = repo.update(func(a []breakfast) error {
+		for i := range a {
+			if a[i].ID == breakfastID {
+				a[i].Image = image
+				b = a[i]
+				return nil
+			}
+		}
+		return notFoundError{breakfastID}
+	})
+	if err != nil {
+		return breakfast{}, err
+	}
+	return repo.decorate(b), nil
+}
+
+var (
+	errInvalidRating        = errors.New("rating must be between 1 and 5")
+	errNoBreakfasts         = errors.New("no breakfasts available")
+	errNoMatchingBreakfasts = errors.New("no breakfasts match the filter")
+)
+
+type notFoundError struct{ breakfastID uint64 }
+
+func (e notFoundError) Error() string { return fmt.Sprintf("no breakfast with ID %d", e.breakfastID) }
+
+func isNotFound(err error) bool {
+	_, ok := err.(notFoundError)
+	return ok || err == errNoMatchingBreakfasts
+}
+
+// isClientError reports whether err is the caller's fault, rather than a
+// sign that the repository itself is unhealthy.
+func isClientError(err error) bool {
+	return isNotFound(err) || err == errInvalidRating
 }
 
 func fakeDatabaseOperation(username string) {
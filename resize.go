@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type resizer interface {
+	resize(ctx context.Context, key string, width, height int) (data []byte, contentType string, cached bool, err error)
+}
+
+const maxResizeDimension = 2048
+
+// maxResizeSourcePixels caps the size of images we'll decode. A small
+// upload can declare huge dimensions, and decoding allocates for all of
+// them; 40 megapixels is already more than most cameras produce.
+const maxResizeSourcePixels = 40 * 1000 * 1000
+
+// imageSrcsetWidths are the variants offered to browsers via srcset.
+var imageSrcsetWidths = []int{250, 500, 1000}
+
+// cachingResizer downscales JPEG and PNG images from an imageStore, and
+// keeps the variants on disk so each is only computed once. Either
+// dimension may be zero, meaning "whatever preserves the aspect ratio".
+// Images are never upscaled, and other formats are returned as-is.
+type cachingResizer struct {
+	images imageStore
+	dir    string
+}
+
+func newCachingResizer(images imageStore, dir string) (*cachingResizer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &cachingResizer{images: images, dir: dir}, nil
+}
+
+func (r *cachingResizer) resize(ctx context.Context, key string, width, height int) ([]byte, string, bool, error) {
+	if !validImageKey(key) {
+		return nil, "", false, errImageNotFound
+	}
+	if width < 0 || height < 0 || width > maxResizeDimension || height > maxResizeDimension {
+		return nil, "", false, errInvalidDimensions
+	}
+
+	var (
+		ext      = filepath.Ext(key)
+		variant  = filepath.Join(r.dir, fmt.Sprintf("%s_%dx%d%s", strings.TrimSuffix(key, ext), width, height, ext))
+		buf, err = ioutil.ReadFile(variant)
+	)
+	if err == nil {
+		return buf, http.DetectContentType(buf), true, nil
+	}
+
+	rc, contentType, _, err := r.images.getImage(ctx, key)
+	if err != nil {
+		return nil, "", false, err
+	}
+	defer rc.Close()
+	original, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	var encode func(*bytes.Buffer, image.Image) error
+	switch contentType = http.DetectContentType(original); contentType {
+	case "image/jpeg":
+		encode = func(buf *bytes.Buffer, img image.Image) error {
+			return jpeg.Encode(buf, img, &jpeg.Options{Quality: 85})
+		}
+	case "image/png":
+		encode = func(buf *bytes.Buffer, img image.Image) error { return png.Encode(buf, img) }
+	default:
+		return original, contentType, false, nil
+	}
+
+	// Check the dimensions in the header before decoding anything. If the
+	// original is already small enough, serve it without decoding at all.
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(original))
+	if err != nil {
+		return nil, "", false, err
+	}
+	if cfg.Width*cfg.Height > maxResizeSourcePixels {
+		return nil, "", false, errImageTooLarge
+	}
+	w, h, ok := fit(cfg.Width, cfg.Height, width, height)
+	if !ok {
+		return original, contentType, false, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	var out bytes.Buffer
+	if err := encode(&out, downscale(src, w, h)); err != nil {
+		return nil, "", false, err
+	}
+	if err := writeFileAtomic(variant, out.Bytes()); err != nil {
+		return nil, "", false, err
+	}
+	return out.Bytes(), contentType, false, nil
+}
+
+var (
+	errInvalidDimensions = fmt.Errorf("image dimensions must be between 0 and %d", maxResizeDimension)
+	errImageTooLarge     = fmt.Errorf("image is over %d pixels, too large to resize", maxResizeSourcePixels)
+)
+
+// fit returns the largest size no bigger than width by height that keeps
+// the source aspect ratio. It returns false if that wouldn't be smaller
+// than the source.
+func fit(srcW, srcH, width, height int) (w, h int, ok bool) {
+	if srcW <= 0 || srcH <= 0 || (width == 0 && height == 0) {
+		return 0, 0, false
+	}
+	switch {
+	case width == 0:
+		w, h = srcW*height/srcH, height
+	case height == 0:
+		w, h = width, srcH*width/srcW
+	case width*srcH < height*srcW: // width is the constraint
+		w, h = width, srcH*width/srcW
+	default:
+		w, h = srcW*height/srcH, height
+	}
+	if w >= srcW || h >= srcH {
+		return 0, 0, false
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h, true
+}
+
+// downscale shrinks src to w by h by averaging each destination pixel's
+// source area. That's simple and good-looking for reductions, which is all
+// we do.
+func downscale(src image.Image, w, h int) *image.RGBA {
+	sb := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, sb.Dx(), sb.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, sb.Min, draw.Src)
+
+	var (
+		sw, sh = sb.Dx(), sb.Dy()
+		dst    = image.NewRGBA(image.Rect(0, 0, w, h))
+	)
+	for dy := 0; dy < h; dy++ {
+		y0, y1 := dy*sh/h, (dy+1)*sh/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for dx := 0; dx < w; dx++ {
+			x0, x1 := dx*sw/w, (dx+1)*sw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sum [4]uint64
+			for y := y0; y < y1; y++ {
+				row := rgba.Pix[y*rgba.Stride+x0*4 : y*rgba.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += uint64(row[i+0])
+					sum[1] += uint64(row[i+1])
+					sum[2] += uint64(row[i+2])
+					sum[3] += uint64(row[i+3])
+				}
+			}
+			n := uint64((y1 - y0) * (x1 - x0))
+			off := dy*dst.Stride + dx*4
+			for c := 0; c < 4; c++ {
+				dst.Pix[off+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
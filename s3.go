@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3ImageStore keeps images in a bucket of an S3-compatible object store.
+// It uses path-style addressing and signs requests with AWS Signature V4,
+// so it works against AWS as well as local stand-ins like MinIO.
+type s3ImageStore struct {
+	endpoint  *url.URL // e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3ImageStore(endpoint, bucket, region, accessKey, secretKey string) (*s3ImageStore, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("S3 endpoint %q must be an absolute URL", endpoint)
+	}
+	return &s3ImageStore{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *s3ImageStore) putImage(ctx context.Context, key, contentType string, data []byte) error {
+	if !validImageKey(key) {
+		return errImageNotFound
+	}
+	req, err := http.NewRequest("PUT", s.objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := s.do(ctx, req, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *s3ImageStore) getImage(ctx context.Context, key string) (io.ReadCloser, string, time.Time, error) {
+	if !validImageKey(key) {
+		return nil, "", time.Time{}, errImageNotFound
+	}
+	req, err := http.NewRequest("GET", s.objectURL(key), nil)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	resp, err := s.do(ctx, req, nil)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified")) // zero if missing
+		return resp.Body, resp.Header.Get("Content-Type"), modTime, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, "", time.Time{}, errImageNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, "", time.Time{}, s3Error(resp)
+	}
+}
+
+func (s *s3ImageStore) objectURL(key string) string {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	return u.String()
+}
+
+func (s *s3ImageStore) do(ctx context.Context, req *http.Request, payload []byte) (*http.Response, error) {
+	s.sign(req, payload, time.Now().UTC())
+	return s.client.Do(req.WithContext(ctx))
+}
+
+// sign adds AWS Signature V4 headers to req. See
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html.
+func (s *s3ImageStore) sign(req *http.Request, payload []byte, now time.Time) {
+	var (
+		amzdate     = now.Format("20060102T150405Z")
+		date        = now.Format("20060102")
+		scope       = date + "/" + s.region + "/s3/aws4_request"
+		payloadHash = hexSHA256(payload)
+	)
+	req.Header.Set("X-Amz-Date", amzdate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzdate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3Error(resp *http.Response) error {
+	buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 %s: %s", resp.Status, strings.TrimSpace(string(buf)))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+type searcher interface {
+	search(ctx context.Context, query string) ([]searchResult, error)
+}
+
+type searchResult struct {
+	breakfast
+	Score float64
+}
+
+// searchIndex is an in-process inverted index over breakfast names and
+// descriptions, ranked with BM25. It's rebuilt wholesale whenever the
+// repository data changes; see fileRepository.subscribe.
+type searchIndex struct {
+	mtx      sync.RWMutex
+	docs     map[uint64]breakfast
+	lengths  map[uint64]float64
+	avglen   float64
+	postings map[string]map[uint64]float64 // term -> breakfast ID -> weighted term frequency
+}
+
+const (
+	searchNameWeight = 2.0 // a term in the name counts this many times
+	searchBM25K1     = 1.2
+	searchBM25B      = 0.75
+)
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{}
+}
+
+func (idx *searchIndex) rebuild(a []breakfast) {
+	var (
+		docs     = make(map[uint64]breakfast, len(a))
+		lengths  = make(map[uint64]float64, len(a))
+		postings = map[string]map[uint64]float64{}
+		total    float64
+	)
+	for _, b := range a {
+		docs[b.ID] = b
+		for _, field := range []struct {
+			text   string
+			weight float64
+		}{
+			{b.Name, searchNameWeight},
+			{b.Description, 1},
+		} {
+			for _, term := range analyze(field.text) {
+				if postings[term] == nil {
+					postings[term] = map[uint64]float64{}
+				}
+				postings[term][b.ID] += field.weight
+				lengths[b.ID] += field.weight
+			}
+		}
+		total += lengths[b.ID]
+	}
+
+	var avglen float64
+	if len(a) > 0 {
+		avglen = total / float64(len(a))
+	}
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	idx.docs, idx.lengths, idx.avglen, idx.postings = docs, lengths, avglen, postings
+}
+
+func (idx *searchIndex) search(_ context.Context, query string) ([]searchResult, error) {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	var (
+		n      = float64(len(idx.docs))
+		scores = map[uint64]float64{}
+	)
+	for _, term := range analyze(query) {
+		docs := idx.postings[term]
+		if len(docs) <= 0 {
+			continue
+		}
+		idf := math.Log(1 + (n-float64(len(docs))+0.5)/(float64(len(docs))+0.5))
+		for id, tf := range docs {
+			norm := searchBM25K1 * (1 - searchBM25B + searchBM25B*idx.lengths[id]/idx.avglen)
+			scores[id] += idf * tf * (searchBM25K1 + 1) / (tf + norm)
+		}
+	}
+
+	results := make([]searchResult, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, searchResult{idx.docs[id], score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results, nil
+}
+
+//
+//
+//
+
+// analyze splits text into lowercase words, drops stopwords, and stems.
+func analyze(text string) (terms []string) {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		if stopwords[w] {
+			continue
+		}
+		terms = append(terms, stem(w))
+	}
+	return terms
+}
+
+var stopwords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "but": true, "by": true, "for": true, "from": true, "here": true,
+	"i": true, "if": true, "in": true, "is": true, "it": true, "its": true,
+	"of": true, "on": true, "or": true, "s": true, "so": true, "some": true,
+	"that": true, "the": true, "there": true, "this": true, "to": true,
+	"too": true, "was": true, "what": true, "with": true, "you": true,
+}
+
+// stem applies steps 1 and 5a of the Porter stemmer, which is enough to
+// conflate plurals and -ed/-ing forms, e.g. eggs/egg, clogging/clog.
+func stem(w string) string {
+	if len(w) <= 2 {
+		return w
+	}
+
+	// Step 1a: plurals.
+	switch {
+	case strings.HasSuffix(w, "sses"):
+		w = w[:len(w)-2]
+	case strings.HasSuffix(w, "ies"):
+		w = w[:len(w)-2]
+	case strings.HasSuffix(w, "ss"):
+	case strings.HasSuffix(w, "s"):
+		w = w[:len(w)-1]
+	}
+
+	// Step 1b: -eed, -ed, -ing.
+	switch {
+	case strings.HasSuffix(w, "eed"):
+		if measure(w[:len(w)-3]) > 0 {
+			w = w[:len(w)-1]
+		}
+	case strings.HasSuffix(w, "ed") && hasVowel(w[:len(w)-2]):
+		w = stem1bFixup(w[:len(w)-2])
+	case strings.HasSuffix(w, "ing") && hasVowel(w[:len(w)-3]):
+		w = stem1bFixup(w[:len(w)-3])
+	}
+
+	// Step 1c: y to i.
+	if strings.HasSuffix(w, "y") && hasVowel(w[:len(w)-1]) {
+		w = w[:len(w)-1] + "i"
+	}
+
+	// Step 5a: trailing e.
+	if strings.HasSuffix(w, "e") {
+		if base := w[:len(w)-1]; measure(base) > 1 || (measure(base) == 1 && !endsCVC(base)) {
+			w = base
+		}
+	}
+
+	return w
+}
+
+func stem1bFixup(w string) string {
+	switch {
+	case strings.HasSuffix(w, "at"), strings.HasSuffix(w, "bl"), strings.HasSuffix(w, "iz"):
+		return w + "e"
+	case endsDoubleConsonant(w) && !strings.HasSuffix(w, "l") && !strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "z"):
+		return w[:len(w)-1]
+	case measure(w) == 1 && endsCVC(w):
+		return w + "e"
+	default:
+		return w
+	}
+}
+
+func isConsonant(w string, i int) bool {
+	switch w[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(w, i-1)
+	default:
+		return true
+	}
+}
+
+// measure counts the vowel-consonant sequences in w, i.e. m in [C](VC)^m[V].
+func measure(w string) (m int) {
+	i := 0
+	for i < len(w) && isConsonant(w, i) {
+		i++
+	}
+	for i < len(w) {
+		for i < len(w) && !isConsonant(w, i) {
+			i++
+		}
+		if i >= len(w) {
+			break
+		}
+		for i < len(w) && isConsonant(w, i) {
+			i++
+		}
+		m++
+	}
+	return m
+}
+
+func hasVowel(w string) bool {
+	for i := range w {
+		if !isConsonant(w, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func endsDoubleConsonant(w string) bool {
+	n := len(w)
+	return n >= 2 && w[n-1] == w[n-2] && isConsonant(w, n-1)
+}
+
+func endsCVC(w string) bool {
+	n := len(w)
+	if n < 3 || !isConsonant(w, n-3) || isConsonant(w, n-2) || !isConsonant(w, n-1) {
+		return false
+	}
+	switch w[n-1] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// session is the state kept for each user between requests.
+type session struct {
+	History   []uint64       `json:"history,omitempty"`   // breakfasts seen in the current cycle
+	Ratings   map[uint64]int `json:"ratings,omitempty"`   // breakfast ID -> 1..5
+	Favorites []uint64       `json:"favorites,omitempty"` // in the order they were added
+}
+
+func (s session) clone() session {
+	c := session{
+		History:   append([]uint64(nil), s.History...),
+		Favorites: append([]uint64(nil), s.Favorites...),
+	}
+	if s.Ratings != nil {
+		c.Ratings = make(map[uint64]int, len(s.Ratings))
+		for id, rating := range s.Ratings {
+			c.Ratings[id] = rating
+		}
+	}
+	return c
+}
+
+// sessionStore keeps per-user state between requests.
+type sessionStore interface {
+	getSession(username string) (session, error)
+	putSession(username string, s session) error
+	allSessions() (map[string]session, error)
+}
+
+type memorySessionStore struct {
+	mtx      sync.Mutex
+	sessions map[string]session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: map[string]session{}}
+}
+
+func (s *memorySessionStore) getSession(username string) (session, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.sessions[username].clone(), nil
+}
+
+func (s *memorySessionStore) putSession(username string, sess session) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.sessions[username] = sess.clone()
+	return nil
+}
+
+func (s *memorySessionStore) allSessions() (map[string]session, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	all := make(map[string]session, len(s.sessions))
+	for username, sess := range s.sessions {
+		all[username] = sess.clone()
+	}
+	return all, nil
+}
+
+// fileSessionStore is a memorySessionStore that writes through to a JSON
+// file, so sessions survive restarts.
+type fileSessionStore struct {
+	filename string
+	mem      *memorySessionStore
+}
+
+func newFileSessionStore(filename string) (*fileSessionStore, error) {
+	mem := newMemorySessionStore()
+	buf, err := ioutil.ReadFile(filename)
+	switch {
+	case os.IsNotExist(err):
+		// start empty
+	case err != nil:
+		return nil, err
+	default:
+		sessions, err := decodeSessions(buf)
+		if err != nil {
+			return nil, err
+		}
+		mem.sessions = sessions
+	}
+	return &fileSessionStore{filename: filename, mem: mem}, nil
+}
+
+// decodeSessions also reads the older format, which kept only each user's
+// history, as a map of username to breakfast IDs. It's rewritten in the
+// current format on the next write.
+func decodeSessions(buf []byte) (map[string]session, error) {
+	var sessions map[string]session
+	err := json.Unmarshal(buf, &sessions)
+	if err == nil {
+		if sessions == nil {
+			sessions = map[string]session{} // the file held null
+		}
+		return sessions, nil
+	}
+	var histories map[string][]uint64
+	if json.Unmarshal(buf, &histories) != nil {
+		return nil, err // report the error for the current format
+	}
+	sessions = make(map[string]session, len(histories))
+	for username, history := range histories {
+		sessions[username] = session{History: history}
+	}
+	return sessions, nil
+}
+
+func (s *fileSessionStore) getSession(username string) (session, error) {
+	return s.mem.getSession(username)
+}
+
+func (s *fileSessionStore) putSession(username string, sess session) error {
+	s.mem.mtx.Lock()
+	defer s.mem.mtx.Unlock()
+	s.mem.sessions[username] = sess.clone()
+	buf, err := json.Marshal(s.mem.sessions)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.filename, buf)
+}
+
+func (s *fileSessionStore) allSessions() (map[string]session, error) {
+	return s.mem.allSessions()
+}
+
+func writeFileAtomic(filename string, buf []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
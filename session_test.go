@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSessionStoreNullFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "breakfast-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "sessions.json")
+	if err := ioutil.WriteFile(filename, []byte("null"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newFileSessionStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.putSession("alice", session{History: []uint64{1, 2}}); err != nil {
+		t.Fatalf("putSession: %v", err)
+	}
+
+	reopened, err := newFileSessionStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := reopened.getSession("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sess.History) != 2 || sess.History[0] != 1 || sess.History[1] != 2 {
+		t.Errorf("history: have %v, want [1 2]", sess.History)
+	}
+}
+
+func TestDecodeSessionsOldFormat(t *testing.T) {
+	sessions, err := decodeSessions([]byte(`{"alice":[3,1]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := sessions["alice"].History; len(have) != 2 || have[0] != 3 || have[1] != 1 {
+		t.Errorf("history: have %v, want [3 1]", have)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// slo is a service level objective over the request duration histogram.
+// Without a latency threshold it's an availability objective, where a good
+// request is a successful one; with a threshold, a good request is one that
+// succeeded within it.
+type slo struct {
+	Name      string      `json:"name"`
+	Component string      `json:"component"`           // e.g. "API"
+	Operation string      `json:"operation,omitempty"` // e.g. "/breakfasts/{id}"; empty means all
+	Objective float64     `json:"objective"`           // e.g. 0.999
+	Window    sloDuration `json:"window"`              // e.g. "30d"
+	Latency   float64     `json:"latency,omitempty"`   // seconds; must be a histogram bucket
+}
+
+type sloConfig struct {
+	SLOs []slo `json:"slos"`
+}
+
+var sloNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_-]*$`)
+
+// loadSLOs reads and validates an SLO config file. Latency thresholds must
+// be among buckets, so the histogram can answer them exactly.
+func loadSLOs(filename string, buckets []float64) ([]slo, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var cfg sloConfig
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	seen := map[string]bool{}
+	for _, s := range cfg.SLOs {
+		switch {
+		case !sloNamePattern.MatchString(s.Name):
+			return nil, fmt.Errorf("%s: invalid SLO name %q", filename, s.Name)
+		case seen[s.Name]:
+			return nil, fmt.Errorf("%s: duplicate SLO %q", filename, s.Name)
+		case s.Component == "":
+			return nil, fmt.Errorf("%s: SLO %q has no component", filename, s.Name)
+		case s.Objective <= 0 || s.Objective >= 1:
+			return nil, fmt.Errorf("%s: SLO %q objective must be between 0 and 1", filename, s.Name)
+		case s.Window <= 0:
+			return nil, fmt.Errorf("%s: SLO %q has no window", filename, s.Name)
+		case s.Latency != 0 && !containsFloat(buckets, s.Latency):
+			return nil, fmt.Errorf("%s: SLO %q latency %v isn't a histogram bucket %v", filename, s.Name, s.Latency, buckets)
+		}
+		seen[s.Name] = true
+	}
+	return cfg.SLOs, nil
+}
+
+func containsFloat(a []float64, f float64) bool {
+	for _, x := range a {
+		if x == f {
+			return true
+		}
+	}
+	return false
+}
+
+// sloCollector exposes the SLIs for each SLO as a pair of counters, total
+// and good requests, derived from the request duration histogram at scrape
+// time. The burn-rate rules from slo-rules are written against them.
+type sloCollector struct {
+	slos     []slo
+	duration *prometheus.HistogramVec
+	total    *prometheus.Desc
+	good     *prometheus.Desc
+}
+
+func newSLOCollector(slos []slo, duration *prometheus.HistogramVec) *sloCollector {
+	return &sloCollector{
+		slos:     slos,
+		duration: duration,
+		total: prometheus.NewDesc(
+			"breakfast_solutions_service_slo_requests_total",
+			"Requests counted toward each SLO.",
+			[]string{"slo"}, nil,
+		),
+		good: prometheus.NewDesc(
+			"breakfast_solutions_service_slo_good_requests_total",
+			"Requests that met each SLO.",
+			[]string{"slo"}, nil,
+		),
+	}
+}
+
+func (c *sloCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.total
+	ch <- c.good
+}
+
+func (c *sloCollector) Collect(ch chan<- prometheus.Metric) {
+	var series []*dto.Metric
+	{
+		metrics := make(chan prometheus.Metric)
+		go func() { c.duration.Collect(metrics); close(metrics) }()
+		for m := range metrics {
+			var pb dto.Metric
+			if err := m.Write(&pb); err == nil {
+				series = append(series, &pb)
+			}
+		}
+	}
+
+	for _, s := range c.slos {
+		var total, good uint64
+		for _, pb := range series {
+			labels := map[string]string{}
+			for _, lp := range pb.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			if labels["component"] != s.Component || (s.Operation != "" && labels["operation"] != s.Operation) {
+				continue
+			}
+			h := pb.GetHistogram()
+			total += h.GetSampleCount()
+			if labels["success"] != "true" {
+				continue
+			}
+			if s.Latency == 0 {
+				good += h.GetSampleCount()
+				continue
+			}
+			for _, b := range h.GetBucket() {
+				if b.GetUpperBound() == s.Latency {
+					good += b.GetCumulativeCount()
+				}
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(c.total, prometheus.CounterValue, float64(total), s.Name)
+		ch <- prometheus.MustNewConstMetric(c.good, prometheus.CounterValue, float64(good), s.Name)
+	}
+}
+
+// sloDuration is a duration in JSON, which also accepts days, like
+// Prometheus: e.g. "30d".
+type sloDuration time.Duration
+
+func (d *sloDuration) UnmarshalJSON(buf []byte) error {
+	var s string
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return err
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*d = sloDuration(time.Duration(days) * 24 * time.Hour)
+		return nil
+	}
+	x, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = sloDuration(x)
+	return nil
+}
+
+// promDuration formats d the way Prometheus range selectors want it, in the
+// largest whole unit.
+func promDuration(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
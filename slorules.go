@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"sort"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// burnRateAlerts are the multi-window, multi-burn-rate alerts from the SRE
+// workbook. Each fires when both windows are burning the error budget fast
+// enough to spend the given fraction of it over the long window.
+var burnRateAlerts = []struct {
+	severity    string
+	long, short time.Duration
+	budget      float64 // fraction of the error budget spent over long
+}{
+	{"page", time.Hour, 5 * time.Minute, 0.02},
+	{"page", 6 * time.Hour, 30 * time.Minute, 0.05},
+	{"ticket", 24 * time.Hour, 2 * time.Hour, 0.10},
+	{"ticket", 72 * time.Hour, 6 * time.Hour, 0.10},
+}
+
+type ruleGroup struct {
+	Name       string
+	Recordings []recordingRule
+	Alerts     []alertRule
+}
+
+type recordingRule struct {
+	Record, SLO, Window string
+}
+
+type alertRule struct {
+	SLO, Severity, Long, Short, For, Threshold string
+}
+
+var rulesTemplate = template.Must(template.New("rules").Parse(`# Generated by breakfast-solutions slo-rules. Do not edit.
+groups:
+{{- range . }}
+- name: {{ .Name }}
+  rules:
+{{- range .Recordings }}
+  - record: slo:error_ratio:rate{{ .Window }}
+    labels:
+      slo: {{ .SLO }}
+    expr: |
+      1 - (
+        sum(rate(breakfast_solutions_service_slo_good_requests_total{slo="{{ .SLO }}"}[{{ .Window }}]))
+        /
+        sum(rate(breakfast_solutions_service_slo_requests_total{slo="{{ .SLO }}"}[{{ .Window }}]))
+      )
+{{- end }}
+{{- range .Alerts }}
+  - alert: ErrorBudgetBurn
+    expr: |
+      slo:error_ratio:rate{{ .Long }}{slo="{{ .SLO }}"} > {{ .Threshold }}
+      and
+      slo:error_ratio:rate{{ .Short }}{slo="{{ .SLO }}"} > {{ .Threshold }}
+    for: {{ .For }}
+    labels:
+      severity: {{ .Severity }}
+      slo: {{ .SLO }}
+    annotations:
+      summary: SLO {{ .SLO }} is burning its error budget too fast ({{ .Long }}/{{ .Short }} windows).
+{{- end }}
+{{- end }}
+`))
+
+// sloRulesCmd writes Prometheus recording and alerting rules for the SLOs
+// in a config file to stdout.
+func sloRulesCmd(args []string) error {
+	var (
+		fs       = flag.NewFlagSet("slo-rules", flag.ExitOnError)
+		filename = fs.String("slo", "slos.json", "SLO config file")
+	)
+	fs.Parse(args)
+
+	slos, err := loadSLOs(*filename, prometheus.DefBuckets)
+	if err != nil {
+		return err
+	}
+	if len(slos) == 0 {
+		return errors.New("no SLOs defined")
+	}
+	return rulesTemplate.Execute(os.Stdout, sloRuleGroups(slos))
+}
+
+func sloRuleGroups(slos []slo) []ruleGroup {
+	var groups []ruleGroup
+	for _, s := range slos {
+		var (
+			g       = ruleGroup{Name: "slo-" + s.Name}
+			window  = time.Duration(s.Window)
+			windows = map[time.Duration]bool{}
+		)
+		for _, a := range burnRateAlerts {
+			if a.long > window {
+				continue
+			}
+			windows[a.long], windows[a.short] = true, true
+			burnRate := a.budget * float64(window) / float64(a.long)
+			g.Alerts = append(g.Alerts, alertRule{
+				SLO:       s.Name,
+				Severity:  a.severity,
+				Long:      promDuration(a.long),
+				Short:     promDuration(a.short),
+				For:       promDuration(a.short / 5),
+				Threshold: strconv.FormatFloat(burnRate*(1-s.Objective), 'g', 6, 64),
+			})
+		}
+		sorted := make([]time.Duration, 0, len(windows))
+		for w := range windows {
+			sorted = append(sorted, w)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		for _, w := range sorted {
+			g.Recordings = append(g.Recordings, recordingRule{SLO: s.Name, Window: promDuration(w)})
+		}
+		groups = append(groups, g)
+	}
+	return groups
+}
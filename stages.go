@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// stageDeps are what stages may need from main to be constructed.
+type stageDeps struct {
+	geo     *geoIP
+	buckets int
+	audit   *auditPublisher // nil without -audit.sink
+}
+
+// preprocessStage is a preprocessor that can be composed by name. Its
+// report returns the keyvals it's responsible for setting in the context,
+// for logs and traces, so each stage only reports what it decided.
+type preprocessStage struct {
+	new    func(stageDeps) (preprocessor, error)
+	report func(ctx context.Context) []interface{}
+}
+
+// preprocessStages and postprocessStages are the stages that can be
+// composed, by name, with -pre and -post.
+var (
+	preprocessStages = map[string]preprocessStage{
+		"geo": {
+			new: func(d stageDeps) (preprocessor, error) { return newGeoPreprocessor(d.geo), nil },
+			report: func(ctx context.Context) []interface{} {
+				return []interface{}{"origin_ip", getContextOriginIP(ctx), "region", getContextRegion(ctx)}
+			},
+		},
+		"bucket": {
+			new: func(d stageDeps) (preprocessor, error) { return newBucketPreprocessor(d.buckets), nil },
+			report: func(ctx context.Context) []interface{} {
+				return []interface{}{"id", bucketString(ctx)}
+			},
+		},
+	}
+	postprocessStages = map[string]func(stageDeps) (postprocessor, error){
+		"basic": func(stageDeps) (postprocessor, error) { return basicPostprocess, nil },
+		"audit": func(d stageDeps) (postprocessor, error) {
+			if d.audit == nil {
+				return nil, errors.New("audit stage requires -audit.sink")
+			}
+			return newAuditPostprocessor(d.audit), nil
+		},
+	}
+)
+
+// newPreprocessorChain builds a preprocessor that runs the named stages in
+// order, each getting the context returned by the one before. Each stage is
+// instrumented on its own, with its name as the operation.
+func newPreprocessorChain(names []string, deps stageDeps) (preprocessor, error) {
+	var stages []preprocessor
+	for _, name := range names {
+		s, ok := preprocessStages[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown preprocessor stage %q (have %s)", name, strings.Join(preprocessStageNames(), ", "))
+		}
+		stage, err := s.new(deps)
+		if err != nil {
+			return nil, err
+		}
+		stage = loggingPreprocessMiddleware(stage, name, s.report)
+		stage = metricsPreprocessMiddleware(stage, name)
+		stage = tracingPreprocessMiddleware(stage, name, s.report)
+		stages = append(stages, stage)
+	}
+	return func(ctx context.Context, originIP string) context.Context {
+		for _, stage := range stages {
+			ctx = stage(ctx, originIP)
+		}
+		return ctx
+	}, nil
+}
+
+// newPostprocessorChain is newPreprocessorChain for postprocessors.
+func newPostprocessorChain(names []string, deps stageDeps) (postprocessor, error) {
+	var stages []postprocessor
+	for _, name := range names {
+		newStage, ok := postprocessStages[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown postprocessor stage %q (have %s)", name, strings.Join(postprocessStageNames(), ", "))
+		}
+		stage, err := newStage(deps)
+		if err != nil {
+			return nil, err
+		}
+		stage = loggingPostprocessMiddleware(stage, name)
+		stage = metricsPostprocessMiddleware(stage, name)
+		stage = tracingPostprocessMiddleware(stage, name)
+		stages = append(stages, stage)
+	}
+	return func(ctx context.Context, username string, success bool) context.Context {
+		for _, stage := range stages {
+			ctx = stage(ctx, username, success)
+		}
+		return ctx
+	}, nil
+}
+
+// parseStages splits a comma-separated list of stage names.
+func parseStages(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// preprocessStageNames and postprocessStageNames list the registered
+// stages, sorted.
+func preprocessStageNames() []string {
+	var names []string
+	for name := range preprocessStages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func postprocessStageNames() []string {
+	var names []string
+	for name := range postprocessStages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newBucketPreprocessor assigns each origin IP to one of n A/B test
+// buckets, consistently, and stores it in the returned context.
+func newBucketPreprocessor(n int) preprocessor {
+	return func(ctx context.Context, originIP string) context.Context {
+		if n <= 1 {
+			return withBucket(ctx, 0)
+		}
+		h := fnv.New32a()
+		h.Write([]byte(originIP))
+		return withBucket(ctx, int(h.Sum32()%uint32(n)))
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// successPolicy decides which response status codes count as a successful
+// request, for metrics and traces. Each route may have its own codes; the
+// rest use the fallback.
+type successPolicy struct {
+	fallback codeSet
+	routes   map[string]codeSet // by operation
+}
+
+// codeSet is a set of status codes, as classes like "2xx" or exact codes
+// like "404".
+type codeSet []string
+
+func (s codeSet) contains(code int) bool {
+	for _, c := range s {
+		if c == strconv.Itoa(code) || c == codeClass(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSuccessPolicy parses e.g. "2xx,3xx,4xx;/admin=2xx,3xx": a default
+// set of codes, and per-route overrides, separated by semicolons.
+func parseSuccessPolicy(s string) (successPolicy, error) {
+	p := successPolicy{routes: map[string]codeSet{}}
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		route, codes := "", part
+		if i := strings.Index(part, "="); i >= 0 {
+			route, codes = strings.TrimSpace(part[:i]), part[i+1:]
+		}
+		var set codeSet
+		for _, c := range strings.Split(codes, ",") {
+			c = strings.ToLower(strings.TrimSpace(c))
+			if !validCode(c) {
+				return successPolicy{}, fmt.Errorf("invalid status code %q", c)
+			}
+			set = append(set, c)
+		}
+		if route == "" {
+			p.fallback = set
+		} else {
+			p.routes[route] = set
+		}
+	}
+	if p.fallback == nil {
+		return successPolicy{}, fmt.Errorf("no default success codes in %q", s)
+	}
+	return p, nil
+}
+
+func validCode(c string) bool {
+	if len(c) != 3 || c[0] < '1' || c[0] > '5' {
+		return false
+	}
+	if c[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(c)
+	return err == nil
+}
+
+func (p successPolicy) success(operation string, code int) bool {
+	if set, ok := p.routes[operation]; ok {
+		return set.contains(code)
+	}
+	return p.fallback.contains(code)
+}
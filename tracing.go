@@ -2,18 +2,30 @@ package main
 
 import (
 	"context"
+	"io"
 	"net/http"
 	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/uber/jaeger-client-go"
 )
 
-func tracingAPIMiddleware(next http.Handler) http.Handler {
+func tracingAPIMiddleware(next http.Handler, success successPolicy, route routeNamer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		iw := &interceptingWriter{0, http.StatusOK, w}
-		span, ctx := opentracing.StartSpanFromContext(r.Context(), "api_request")
+		var (
+			iw        = &interceptingWriter{0, http.StatusOK, w}
+			operation = route(r)
+		)
+		span, ctx := opentracing.StartSpanFromContext(r.Context(), operation)
 		defer span.Finish()
 		defer func(begin time.Time) {
+			ext.HTTPMethod.Set(span, r.Method)
+			ext.HTTPUrl.Set(span, r.URL.String())
+			ext.HTTPStatusCode.Set(span, uint16(iw.code))
+			if !success.success(operation, iw.code) {
+				ext.Error.Set(span, true)
+			}
 			span.LogKV(
 				"remote_addr", r.RemoteAddr,
 				"method", r.Method,
@@ -30,63 +42,108 @@ func tracingAPIMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func tracingPreprocessMiddleware(next preprocessor) preprocessor {
-	return func(ctx context.Context, region string) context.Context {
-		span, ctx := opentracing.StartSpanFromContext(ctx, "preprocess")
+func tracingPreprocessMiddleware(next preprocessor, stage string, report func(context.Context) []interface{}) preprocessor {
+	return func(ctx context.Context, originIP string) (result context.Context) {
+		parent := opentracing.SpanFromContext(ctx)
+		span, ctx := opentracing.StartSpanFromContext(ctx, "preprocess_"+stage)
 		defer span.Finish()
 		defer func(begin time.Time) {
-			span.LogKV(
-				"region", region,
+			span.LogKV(append(report(result),
 				"took", time.Since(begin).String(),
 				"sec", time.Since(begin).Seconds(),
-			)
+			)...)
 		}(time.Now())
-		return next(ctx, region)
+		// Later stages are siblings of this span, not children.
+		return opentracing.ContextWithSpan(next(ctx, originIP), parent)
 	}
 }
 
-type tracingRepoMiddleware struct {
-	next repository
+type tracingSearchMiddleware struct {
+	next searcher
+}
+
+func (m tracingSearchMiddleware) search(ctx context.Context, query string) (results []searchResult, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "search")
+	defer span.Finish()
+	defer func(begin time.Time) {
+		span.LogKV(
+			"query", query,
+			"took", time.Since(begin).String(),
+			"sec", time.Since(begin).Seconds(),
+			"success", err == nil,
+			"returned_count", len(results),
+			"err", err,
+		)
+	}(time.Now())
+	return m.next.search(ctx, query)
+}
+
+type tracingImageMiddleware struct {
+	next imageStore
+}
+
+func (m tracingImageMiddleware) putImage(ctx context.Context, key, contentType string, data []byte) (err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "images_request")
+	defer span.Finish()
+	defer func(begin time.Time) {
+		span.LogKV(
+			"method", "putImage",
+			"key", key,
+			"content_type", contentType,
+			"size", len(data),
+			"took", time.Since(begin).String(),
+			"sec", time.Since(begin).Seconds(),
+			"success", err == nil,
+			"err", err,
+		)
+	}(time.Now())
+	return m.next.putImage(ctx, key, contentType, data)
 }
 
-func (m tracingRepoMiddleware) getBreakfast(ctx context.Context, username string, breakfastID uint64) (b breakfast, err error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "db_request")
+func (m tracingImageMiddleware) getImage(ctx context.Context, key string) (rc io.ReadCloser, contentType string, modTime time.Time, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "images_request")
 	defer span.Finish()
 	defer func(begin time.Time) {
 		span.LogKV(
-			"method", "getBreakfast",
-			"username", username,
-			"breakfast_id", breakfastID,
+			"method", "getImage",
+			"key", key,
+			"content_type", contentType,
 			"took", time.Since(begin).String(),
 			"sec", time.Since(begin).Seconds(),
 			"success", err == nil,
-			"returned_breakfast_id", b.ID,
 			"err", err,
 		)
 	}(time.Now())
-	return m.next.getBreakfast(ctx, username, breakfastID)
+	return m.next.getImage(ctx, key)
+}
+
+type tracingResizeMiddleware struct {
+	next resizer
 }
 
-func (m tracingRepoMiddleware) getRandomBreakfast(ctx context.Context, username string) (b breakfast, err error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "db_request")
+func (m tracingResizeMiddleware) resize(ctx context.Context, key string, width, height int) (data []byte, contentType string, cached bool, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "resize")
 	defer span.Finish()
 	defer func(begin time.Time) {
 		span.LogKV(
-			"method", "getRandomBreakfast",
-			"username", username,
+			"key", key,
+			"width", width,
+			"height", height,
+			"cached", cached,
+			"size", len(data),
 			"took", time.Since(begin).String(),
 			"sec", time.Since(begin).Seconds(),
 			"success", err == nil,
-			"returned_breakfast_id", b.ID,
 			"err", err,
 		)
 	}(time.Now())
-	return m.next.getRandomBreakfast(ctx, username)
+	return m.next.resize(ctx, key, width, height)
 }
 
-func tracingPostprocessMiddleware(next postprocessor) postprocessor {
+func tracingPostprocessMiddleware(next postprocessor, stage string) postprocessor {
 	return func(ctx context.Context, username string, success bool) context.Context {
-		span, ctx := opentracing.StartSpanFromContext(ctx, "postprocess")
+		parent := opentracing.SpanFromContext(ctx)
+		span, ctx := opentracing.StartSpanFromContext(ctx, "postprocess_"+stage)
 		defer span.Finish()
 		defer func(begin time.Time) {
 			span.LogKV(
@@ -96,6 +153,25 @@ func tracingPostprocessMiddleware(next postprocessor) postprocessor {
 				"sec", time.Since(begin).Seconds(),
 			)
 		}(time.Now())
-		return next(ctx, username, success)
+		return opentracing.ContextWithSpan(next(ctx, username, success), parent)
+	}
+}
+
+//
+//
+//
+
+// getTraceID returns the ID of the trace the span in ctx belongs to, and
+// whether the trace is sampled, i.e. will be found in Jaeger. It returns
+// an empty ID if there's no Jaeger span.
+func getTraceID(ctx context.Context) (traceID string, sampled bool) {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return "", false
+	}
+	sc, ok := span.Context().(jaeger.SpanContext)
+	if !ok {
+		return "", false
 	}
+	return sc.TraceID().String(), sc.IsSampled()
 }
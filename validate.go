@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// validateCmd checks a database file before it's deployed, and prints each
+// problem it finds.
+var validateCmd = batchCmd("validate", func(fs *flag.FlagSet, args []string, auto promauto.Factory) error {
+	var (
+		db     = fs.String("db", "breakfasts.json", "database file")
+		images = fs.String("images", "", "image dir to check image references against (empty skips the check)")
+	)
+	fs.Parse(args)
+
+	var (
+		checked = auto.NewGauge(prometheus.GaugeOpts{
+			Namespace: "breakfast_solutions",
+			Subsystem: "validate",
+			Name:      "breakfasts",
+			Help:      "Breakfasts checked in the database file.",
+		})
+		problems = auto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "breakfast_solutions",
+			Subsystem: "validate",
+			Name:      "problems",
+			Help:      "Problems found in the database file, by kind.",
+		}, []string{"kind"})
+	)
+
+	buf, err := ioutil.ReadFile(*db)
+	if err != nil {
+		return err
+	}
+	var a []breakfast
+	if err := json.Unmarshal(buf, &a); err != nil {
+		return fmt.Errorf("%s: %v", *db, err)
+	}
+	checked.Set(float64(len(a)))
+
+	var n int
+	problem := func(kind string, b breakfast, format string, args ...interface{}) {
+		fmt.Fprintf(os.Stdout, "%s: breakfast %d: %s\n", *db, b.ID, fmt.Sprintf(format, args...))
+		problems.WithLabelValues(kind).Inc()
+		n++
+	}
+	seen := map[uint64]bool{}
+	for _, b := range a {
+		switch {
+		case b.ID == 0:
+			problem("id", b, "missing ID")
+		case seen[b.ID]:
+			problem("id", b, "duplicate ID")
+		}
+		seen[b.ID] = true
+		if b.Name == "" {
+			problem("name", b, "missing name")
+		}
+		if b.Calories < 0 {
+			problem("calories", b, "negative calories %d", b.Calories)
+		}
+		if b.Image == "" {
+			continue
+		}
+		key := strings.TrimPrefix(b.Image, "/images/")
+		switch {
+		case key == b.Image || !validImageKey(key):
+			problem("image", b, "invalid image %q", b.Image)
+		case *images != "":
+			if _, err := os.Stat(filepath.Join(*images, key)); err != nil {
+				problem("image", b, "image %q: %v", b.Image, err)
+			}
+		}
+	}
+	if n > 0 {
+		return fmt.Errorf("%d problem(s) in %d breakfasts", n, len(a))
+	}
+	return nil
+})
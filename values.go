@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// Request-scoped values that stages pass forward. A stage sets them with
+// the with functions, on the context it returns; later stages read them
+// with the getContext functions, which return a zero value if unset. The
+// keys are unexported, so values can only be set through this API.
+
+type (
+	contextRegionKey     struct{}
+	contextRegionHintKey struct{}
+	contextOriginIPKey   struct{}
+	contextBucketKey     struct{}
+	contextBreakfastKey  struct{}
+)
+
+// withRegion records the region the request came from, as resolved by the
+// preprocessor.
+func withRegion(ctx context.Context, region string) context.Context {
+	return context.WithValue(ctx, contextRegionKey{}, region)
+}
+
+// getContextRegion returns unknownRegion if the region isn't known.
+func getContextRegion(ctx context.Context) string {
+	region, ok := ctx.Value(contextRegionKey{}).(string)
+	if !ok {
+		return unknownRegion
+	}
+	return region
+}
+
+// withRegionHint provides a region to use when the origin IP can't be
+// resolved, e.g. from ?region= in debug mode.
+func withRegionHint(ctx context.Context, region string) context.Context {
+	return context.WithValue(ctx, contextRegionHintKey{}, strings.ToLower(region))
+}
+
+func getContextRegionHint(ctx context.Context) string {
+	hint, _ := ctx.Value(contextRegionHintKey{}).(string)
+	return hint
+}
+
+// withOriginIP records the address of the client, as seen by the
+// preprocessor.
+func withOriginIP(ctx context.Context, originIP string) context.Context {
+	return context.WithValue(ctx, contextOriginIPKey{}, originIP)
+}
+
+func getContextOriginIP(ctx context.Context) string {
+	originIP, _ := ctx.Value(contextOriginIPKey{}).(string)
+	return originIP
+}
+
+// withBucket records the A/B test bucket the request was assigned to.
+func withBucket(ctx context.Context, bucket int) context.Context {
+	return context.WithValue(ctx, contextBucketKey{}, bucket)
+}
+
+// getContextBucket returns false if the request wasn't assigned a bucket.
+func getContextBucket(ctx context.Context) (int, bool) {
+	bucket, ok := ctx.Value(contextBucketKey{}).(int)
+	return bucket, ok
+}
+
+// withBreakfastID records the breakfast the handler served, or tried to
+// serve, for postprocessors.
+func withBreakfastID(ctx context.Context, id uint64) context.Context {
+	return context.WithValue(ctx, contextBreakfastKey{}, id)
+}
+
+// getContextBreakfastID returns false if the request wasn't for a
+// particular breakfast.
+func getContextBreakfastID(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(contextBreakfastKey{}).(uint64)
+	return id, ok
+}
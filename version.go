@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=$(git describe --tags --always) -X main.commit=$(git rev-parse HEAD)"
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+func versionCmd(args []string) error {
+	fmt.Printf("breakfast-solutions %s (commit %s, %s)\n", version, commit, runtime.Version())
+	return nil
+}
+
+// newRegistry returns a registry with the process and Go runtime collectors,
+// and a build_info gauge identifying this binary.
+func newRegistry() *prometheus.Registry {
+	buildInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "breakfast_solutions",
+		Name:      "build_info",
+		Help:      "Always 1, labeled with the version, commit and Go version of the binary.",
+		ConstLabels: prometheus.Labels{
+			"version":   version,
+			"commit":    commit,
+			"goversion": runtime.Version(),
+		},
+	})
+	buildInfo.Set(1)
+
+	r := prometheus.NewRegistry()
+	r.MustRegister(
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		buildInfo,
+	)
+	return r
+}